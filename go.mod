@@ -2,4 +2,8 @@ module github.com/MAD-py/grx
 
 go 1.19
 
-require gopkg.in/yaml.v3 v3.0.1 // indirect
+require (
+	golang.org/x/crypto v0.10.0
+	golang.org/x/net v0.11.0
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -1,11 +1,247 @@
 package config
 
-import "time"
+import (
+	"net/http"
+	"net/netip"
+	"regexp"
+	"time"
+)
 
 type Server struct {
 	Name           string
 	ListenAddr     string
 	MaxConnections int
+
+	// Limit of requests per client, nil if there is no limit.
+	RateLimit *RateLimit
+
+	// Deadlines and limits of the client connections.
+	Client ClientLimits
+
+	// What to do with the new connections when the server has
+	// reached its maximum number of connections.
+	Overload Overload
+
+	// Limits of simultaneous connections and requests of each client,
+	// nil if there are no limits.
+	PerClient *PerClient
+
+	// Clients allowed to connect, nil if all of them are allowed.
+	Access *Access
+
+	// Users allowed to send requests, nil if no authentication is needed.
+	BasicAuth *BasicAuth
+
+	// Validation of the bearer tokens of the requests, nil if no
+	// authentication is needed.
+	JWT *JWT
+
+	// External service that authorizes the requests, nil if they are not
+	// authorized.
+	AuthRequest *AuthRequest
+
+	// Rules that block the requests, nil if they are not filtered.
+	Filter *Filter
+
+	// Cross-origin requests allowed, nil if the CORS headers are left to
+	// the servers.
+	CORS *CORS
+}
+
+// CORS answers the preflight requests and adds the CORS headers to the
+// responses of the allowed origins.
+type CORS struct {
+	// Allowed origins, exact or with a wildcard subdomain (e.g.
+	// https://*.example.com). "*" allows all of them.
+	Origins []string
+
+	// Patterns of allowed origins.
+	OriginPatterns []*regexp.Regexp
+
+	Methods []string
+
+	// Allowed request headers, empty if the requested ones are allowed.
+	Headers []string
+
+	// Response headers that can be read by the clients.
+	ExposeHeaders []string
+
+	Credentials bool
+
+	// Time the clients can cache the preflight responses, 0 if it is not
+	// sent.
+	MaxAge time.Duration
+
+	// Keeps the CORS headers of the servers instead of replacing them,
+	// only the missing ones are added.
+	Merge bool
+}
+
+// Filter contains the rules that block the requests before they are
+// processed.
+type Filter struct {
+	// Allowed methods, empty if all of them are allowed.
+	Methods []string
+
+	// Maximum length of the URI, 0 if there is no limit.
+	MaxURLLength int
+
+	// Patterns that block the requests matching them.
+	Path      []*regexp.Regexp
+	Query     []*regexp.Regexp
+	UserAgent []*regexp.Regexp
+	Headers   map[string][]*regexp.Regexp
+
+	// Known attacks that are blocked (path_traversal, sql_injection).
+	Signatures []string
+
+	// Only logs the requests that break the rules instead of blocking
+	// them.
+	DetectOnly bool
+}
+
+// AuthRequest authorizes the requests with a subrequest to an external
+// service, the request is allowed if the service responds with a 2xx.
+type AuthRequest struct {
+	URL string
+
+	// Headers of the request sent to the service.
+	Headers []string
+
+	// Headers of the response of the service copied to the forwarded
+	// request.
+	ResponseHeaders []string
+
+	// Page where the clients are redirected when the service responds
+	// with a 401, empty if the response of the service is sent.
+	LoginURL string
+
+	// Time the allowed requests are remembered, 0 if they are not.
+	CacheTTL time.Duration
+
+	Timeout time.Duration
+}
+
+// JWT validates the bearer tokens of the requests with the keys of a JWKS
+// file or URL.
+type JWT struct {
+	Realm string
+
+	JWKSFile string
+	JWKSURL  string
+
+	// Time after which the keys are read again.
+	Refresh time.Duration
+
+	// Expected issuer, empty if it is not checked.
+	Issuer string
+
+	// Accepted audiences, the token must have one of them. Empty if it is
+	// not checked.
+	Audience []string
+
+	// Tolerance for the difference between the clocks when checking the
+	// expiration and the start of the tokens.
+	ClockSkew time.Duration
+
+	// Rejects the tokens without expiration.
+	RequireExp bool
+
+	// Claims that must be present in the tokens.
+	RequiredClaims []string
+
+	// Claims copied to the headers of the forwarded requests, by header.
+	Headers map[string]string
+}
+
+// BasicAuth authenticates the requests with the users of a htpasswd file.
+type BasicAuth struct {
+	Realm string
+
+	// htpasswd file, it is read again when it changes.
+	File string
+
+	// Removes the Authorization header before forwarding the request.
+	StripHeader bool
+
+	// Failed attempts after which a client is locked out, 0 if the clients
+	// are never locked out.
+	MaxFailures int
+
+	// Time the failures of a client are remembered and it is locked out.
+	Lockout time.Duration
+}
+
+// Access contains the rules that allow or deny the clients by their IP,
+// the first rule that contains the IP is applied and the clients that do
+// not match any rule are allowed.
+type Access struct {
+	Rules []*AccessRule
+
+	// Closes the connections of the denied clients instead of
+	// responding with a 403.
+	Drop bool
+}
+
+type AccessRule struct {
+	Allow bool
+
+	Prefixes []netip.Prefix
+}
+
+// PerClient limits the simultaneous connections and requests of each
+// client IP and of each network prefix, the limits that are 0 are not
+// applied.
+type PerClient struct {
+	Connections int
+
+	Requests int
+
+	PrefixConnections int
+
+	PrefixRequests int
+
+	// Length of the prefixes that group the clients.
+	IPv4Prefix int
+	IPv6Prefix int
+
+	// Clients that are not limited.
+	Allow []netip.Prefix
+}
+
+// Overload describes how the connections over the limit are handled.
+type Overload struct {
+	Policy OverloadPolicy
+
+	// Time a connection waits for a free slot, 0 to wait indefinitely.
+	Timeout time.Duration
+
+	// Connections that can wait up to Timeout at the same time, the
+	// next ones are rejected.
+	QueueSize int
+
+	// Value of the Retry-After header of the rejected connections.
+	RetryAfter time.Duration
+}
+
+// ClientLimits protects the server from slow or abusive clients, the
+// timeouts and limits that are 0 are not applied.
+type ClientLimits struct {
+	// Time to wait for the first byte of the request.
+	IdleTimeout time.Duration
+
+	// Time to read the headers of the request.
+	HeaderTimeout time.Duration
+
+	// Time to read the body of the request.
+	BodyTimeout time.Duration
+
+	// Time to write the response.
+	WriteTimeout time.Duration
+
+	MaxHeaderSize int64
+
+	MaxHeaders int
 }
 
 type ForwardServer struct {
@@ -20,6 +256,115 @@ type ForwardServer struct {
 	UseForwarded bool
 
 	TimeoutPerRequest time.Duration
+
+	// Session affinity based on a cookie, nil if it is disabled.
+	Sticky *Sticky
+
+	// Active health check of the forwards, nil if it is disabled.
+	HealthCheck *HealthCheck
+
+	// Passive health check of the forwards, nil if it is disabled.
+	OutlierDetection *OutlierDetection
+
+	// Retries of the failed requests, nil if they are disabled.
+	Retry *Retry
+
+	// Circuit breaker of each forward, nil if it is disabled.
+	CircuitBreaker *CircuitBreaker
+
+	// DNS server used to discover the forwards.
+	Resolver *Resolver
+
+	// Dynamic source of forwards, nil if it is not used.
+	Discovery *Discovery
+
+	// Groups of forwards between which the traffic is split, if there
+	// are groups the forwards of the server are defined in them.
+	Groups []*Group
+
+	// How the traffic is split between the groups, nil to split
+	// it randomly.
+	Split *Split
+
+	// Shadow servers that receive a copy of the requests, nil if the
+	// requests are not mirrored.
+	Mirror *Mirror
+
+	// Limit of simultaneous requests of the forwards that do not
+	// define their own, 0 if there is no limit.
+	MaxConns int
+
+	// Wait for a forward when all of them have reached their limit,
+	// nil to respond immediately with an error.
+	Queue *Queue
+
+	// Maximum size of the request bodies, 0 if there is no limit.
+	MaxBodySize int64
+
+	// Reads the whole request body before contacting the forward,
+	// nil to stream it.
+	Spool *Spool
+
+	// Responses kept in memory to answer the same requests, nil if they
+	// are not cached.
+	Cache *Cache
+}
+
+// Cache keeps the cacheable responses in memory following their
+// Cache-Control, the least recently used are removed when it is full.
+type Cache struct {
+	// Maximum size of all the responses.
+	MaxSize int64
+
+	// Maximum size of a response, the bigger ones are not cached.
+	MaxEntrySize int64
+
+	// Parts of the requests that identify their responses: host, path,
+	// query, header:<name> or cookie:<name>.
+	Key []string
+
+	// Time the responses without expiration are fresh, 0 if they must be
+	// revalidated.
+	DefaultTTL time.Duration
+}
+
+// Group is a named set of forwards with its own load balancer.
+type Group struct {
+	Name string
+
+	LoadBalancer LoadBalancer
+
+	Forward []*Forward
+
+	Resolver *Resolver
+
+	Discovery *Discovery
+
+	// Share of the traffic received by the group, relative to the
+	// weights of the other groups. 1 by default, 0 if the group only
+	// receives the requests of its match.
+	Weight int
+
+	// Requests that are always sent to the group, nil if there are none.
+	Match *Match
+}
+
+// Match contains the values that the headers and cookies of a request
+// must have, all of them must be equal.
+type Match struct {
+	Header map[string]string
+
+	Cookie map[string]string
+}
+
+// Split describes the value of the requests used to split the traffic,
+// the same value is always sent to the same group.
+type Split struct {
+	HashIP bool
+
+	HashHeader string
+
+	HashCookie string
 }
 
 type StaticServer struct {
@@ -31,11 +376,278 @@ type StaticServer struct {
 type Forward struct {
 	Addr string
 
+	// Host and port resolved periodically, each A/AAAA record is a forward.
+	DNS string
+
+	// Service resolved periodically, each SRV record is a forward.
+	SRV string
+
 	Weight uint8
+
+	// Only receives requests when none of the other forwards is available.
+	Backup bool
+
+	// Time during which the weight grows linearly after the forward
+	// is added or becomes healthy again.
+	SlowStart time.Duration
+
+	// Maximum number of simultaneous requests, 0 if there is no limit.
+	MaxConns int
+}
+
+// Sticky contains the attributes of the cookie used to keep a client
+// attached to the same forward.
+type Sticky struct {
+	CookieName string
+
+	// Key of the HMAC that identifies the forwards in the cookie, a random
+	// one is generated if empty, then the cookies do not survive restarts.
+	Secret string
+
+	TTL time.Duration
+
+	Path string
+
+	Secure bool
+
+	HttpOnly bool
+
+	SameSite http.SameSite
+}
+
+// HealthCheck describes the probe sent periodically to each forward
+// to decide if it can receive requests.
+type HealthCheck struct {
+	// Only checks that a TCP connection can be established.
+	TCP bool
+
+	// Path requested in HTTP checks.
+	Path string
+
+	// Status codes considered healthy, any 2xx or 3xx if empty.
+	Status []int
+
+	// Substring that the body of the response must contain.
+	Body string
+
+	Interval time.Duration
+
+	Timeout time.Duration
+
+	// Consecutive successful checks to consider a forward healthy.
+	Rise int
+
+	// Consecutive failed checks to consider a forward unhealthy.
+	Fall int
+}
+
+// OutlierDetection describes when a forward is ejected based on the
+// results of the requests sent to it.
+type OutlierDetection struct {
+	// Failures allowed within FailTimeout before ejecting a forward.
+	MaxFails int
+
+	FailTimeout time.Duration
+
+	// Status codes of the responses considered failures.
+	Status []int
+
+	// Ejection time of the first ejection, it grows with each
+	// consecutive ejection up to MaxEjectionTime.
+	EjectionTime time.Duration
+
+	MaxEjectionTime time.Duration
+
+	// Maximum percentage of the forwards that can be ejected at once.
+	MaxEjectionPercent int
+}
+
+// Retry describes when and how a failed request is sent to another forward.
+type Retry struct {
+	// Maximum number of attempts, including the first one.
+	Attempts int
+
+	// Retry when the forward can not be reached or closes the connection.
+	OnConnectError bool
+
+	// Retry when the forward does not respond in time.
+	OnTimeout bool
+
+	// Status codes of the responses that are retried.
+	Status []int
+
+	// Allows retrying methods that are not idempotent (POST, PATCH...).
+	NonIdempotent bool
+
+	// Timeout of each attempt, zero to use only the request timeout.
+	TryTimeout time.Duration
+
+	// Percentage of the requests that can be retried.
+	Budget int
+
+	// Retries per second allowed regardless of the budget.
+	MinRetries int
+}
+
+// CircuitBreaker describes when the requests to a forward are cut off.
+type CircuitBreaker struct {
+	// Consecutive failures that open the circuit.
+	ConsecutiveFailures int
+
+	// Percentage of failed requests within Window that opens the circuit.
+	ErrorRate int
+
+	// Requests within Window required to take into account the ErrorRate.
+	MinRequests int
+
+	Window time.Duration
+
+	// Time the circuit stays open before allowing probe requests.
+	OpenTime time.Duration
+
+	// Probe requests allowed while the circuit is half-open, all of
+	// them must succeed to close the circuit.
+	HalfOpenRequests int
+
+	// Status codes of the responses considered failures.
+	Status []int
+}
+
+// Resolver describes the DNS server used to resolve the dns and srv forwards.
+type Resolver struct {
+	// Address of the DNS server, the system one if empty.
+	Addr string
+
+	// Maximum time between resolutions, they are more frequent
+	// if the TTL of the records is lower.
+	Interval time.Duration
+}
+
+// Discovery describes where the forwards are obtained from at runtime.
+type Discovery struct {
+	// File with the list of forwards in JSON or YAML format.
+	File string
+
+	// URL of the registry that returns the list of forwards in JSON format.
+	URL string
+
+	// How to extract the forwards from the response of the registry,
+	// nil if it has the same format as the files.
+	Mapping *DiscoveryMapping
+
+	// Uses blocking queries (Consul style) to be notified of the changes.
+	LongPoll bool
+
+	// Time between checks when the changes can not be watched.
+	Interval time.Duration
+}
+
+// DiscoveryMapping contains the paths (fields separated by dots) to the
+// values of the JSON returned by a registry.
+type DiscoveryMapping struct {
+	// Path to the list of forwards, empty if it is the root.
+	List string
+
+	// Paths to the address, the first one that is not empty is used,
+	// it can contain the port.
+	Address []string
+
+	// Path to the port, empty if the address contains it.
+	Port string
+
+	// Path to the weight, empty to use 1.
+	Weight string
+
+	// Path to the list of health checks, the forwards with a check whose
+	// Status is not "passing" are skipped. Empty to use all the forwards.
+	Checks string
+}
+
+// RateLimit limits the requests of each key, the key is the client IP,
+// the value of a header or the whole server.
+type RateLimit struct {
+	// Header whose value is the key, the client IP is used if the request
+	// does not have it. Empty to use the client IP.
+	KeyHeader string
+
+	// All the requests of the server share the same limit.
+	KeyServer bool
+
+	// Uses a sliding window instead of a token bucket.
+	SlidingWindow bool
+
+	// Requests allowed in each period.
+	Rate int
+
+	Period time.Duration
+
+	// Requests allowed at once by the token bucket.
+	Burst int
+
+	// Maximum time a request waits for the limit instead of being
+	// rejected, 0 to reject it immediately.
+	Delay time.Duration
+
+	// Maximum number of keys kept, the least recently used are forgotten.
+	MaxKeys int
+}
+
+// Spool describes where the request bodies are stored while they are read.
+type Spool struct {
+	// Bodies larger than this are written to a temporary file.
+	MemorySize int64
+
+	// Directory of the temporary files, empty to use the default one.
+	Dir string
+}
+
+// Queue bounds the requests that wait for a forward to be released.
+type Queue struct {
+	Size int
+
+	Timeout time.Duration
+}
+
+// Mirror describes the copies of the requests sent to a shadow upstream,
+// its responses are discarded.
+type Mirror struct {
+	Forward []*Forward
+
+	// Percentage of the requests that are mirrored.
+	Percent float64
+
+	// Requests with larger bodies are not mirrored.
+	MaxBodySize int64
+
+	// Time limit of each mirrored request.
+	Timeout time.Duration
 }
 
 type Servers []any
 
+type OverloadPolicy uint8
+
+const (
+	// Waits for a free slot, the connections that wait too long are rejected.
+	OverloadWait OverloadPolicy = iota
+	// Responds immediately with a 503.
+	OverloadReject
+	// Closes the connection without a response.
+	OverloadClose
+)
+
+func (p OverloadPolicy) String() string {
+	switch p {
+	case OverloadWait:
+		return "wait"
+	case OverloadReject:
+		return "reject"
+	case OverloadClose:
+		return "close"
+	}
+	return "unknown"
+}
+
 type LoadBalancer uint8
 
 const (
@@ -43,6 +655,8 @@ const (
 	Base
 	RoundRobin
 	WeightedRoundRobin
+	PowerOfTwoChoices
+	PeakEWMA
 )
 
 func (s LoadBalancer) String() string {
@@ -53,6 +667,10 @@ func (s LoadBalancer) String() string {
 		return "Round Robin"
 	case WeightedRoundRobin:
 		return "Weighted Round Robin"
+	case PowerOfTwoChoices:
+		return "Power of Two Choices"
+	case PeakEWMA:
+		return "Peak EWMA"
 	}
 	return "unknown"
 }
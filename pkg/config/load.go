@@ -3,7 +3,13 @@ package config
 import (
 	"errors"
 	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -58,6 +64,75 @@ func loadServer(serverData any, index int) (any, error) {
 			return nil, err
 		}
 
+		client, err := loadServerClient(serverData, name)
+		if err != nil {
+			return nil, err
+		}
+
+		overload, err := loadServerOverload(serverData, name)
+		if err != nil {
+			return nil, err
+		}
+
+		access, err := loadServerAccess(serverData, name)
+		if err != nil {
+			return nil, err
+		}
+
+		basicAuth, err := loadServerBasicAuth(serverData, name)
+		if err != nil {
+			return nil, err
+		}
+
+		jwt, err := loadServerJWT(serverData, name)
+		if err != nil {
+			return nil, err
+		}
+		if basicAuth != nil && jwt != nil {
+			return nil, fmt.Errorf("%s can not use basic_auth and jwt at the same time", name)
+		}
+
+		authRequest, err := loadServerAuthRequest(serverData, name)
+		if err != nil {
+			return nil, err
+		}
+
+		filter, err := loadServerFilter(serverData, name)
+		if err != nil {
+			return nil, err
+		}
+
+		cors, err := loadServerCORS(serverData, name)
+		if err != nil {
+			return nil, err
+		}
+
+		perClient, err := loadServerPerClient(serverData, name)
+		if err != nil {
+			return nil, err
+		}
+
+		rateLimit, err := loadServerRateLimit(serverData, name)
+		if err != nil {
+			return nil, err
+		}
+
+		server := Server{
+			Name:           name,
+			ListenAddr:     listen,
+			MaxConnections: maxConnection,
+			RateLimit:      rateLimit,
+			Client:         client,
+			Overload:       overload,
+			PerClient:      perClient,
+			Access:         access,
+			BasicAuth:      basicAuth,
+			JWT:            jwt,
+			AuthRequest:    authRequest,
+			Filter:         filter,
+			CORS:           cors,
+		}
+
 		serve, ok, err := loadServerServe(serverData, name)
 		if err != nil {
 			return nil, err
@@ -65,36 +140,118 @@ func loadServer(serverData any, index int) (any, error) {
 
 		if ok {
 			return &StaticServer{
-				Server: Server{
-					Name:           name,
-					ListenAddr:     listen,
-					MaxConnections: maxConnection,
-				},
+				Server:     server,
 				PathPrefix: serve,
 			}, nil
 		}
 
-		forward, loadBalancer, err := loadServerForward(serverData, name)
+		resolver, err := loadServerResolver(serverData, name)
+		if err != nil {
+			return nil, err
+		}
+
+		groups, err := loadServerGroups(serverData, name, resolver)
+		if err != nil {
+			return nil, err
+		}
+
+		split, err := loadServerSplit(serverData, name, groups)
 		if err != nil {
 			return nil, err
 		}
 
+		var forward []*Forward
+		var loadBalancer LoadBalancer
+		var discovery *Discovery
+		if groups == nil {
+			forward, loadBalancer, err = loadServerForward(serverData, name)
+			if err != nil {
+				return nil, err
+			}
+
+			loadBalancer, err = loadServerBalancer(serverData, name, loadBalancer)
+			if err != nil {
+				return nil, err
+			}
+
+			discovery, err = loadServerDiscovery(serverData, name)
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		useForwarded, id, err := loadServerHeader(serverData, name)
 		if err != nil {
 			return nil, err
 		}
 
+		sticky, err := loadServerSticky(serverData, name)
+		if err != nil {
+			return nil, err
+		}
+
+		healthCheck, err := loadServerHealthCheck(serverData, name)
+		if err != nil {
+			return nil, err
+		}
+
+		outlierDetection, err := loadServerOutlierDetection(serverData, name)
+		if err != nil {
+			return nil, err
+		}
+
+		retry, err := loadServerRetry(serverData, name)
+		if err != nil {
+			return nil, err
+		}
+
+		circuitBreaker, err := loadServerCircuitBreaker(serverData, name)
+		if err != nil {
+			return nil, err
+		}
+
+		mirror, err := loadServerMirror(serverData, name)
+		if err != nil {
+			return nil, err
+		}
+
+		maxConns, queue, err := loadServerQueue(serverData, name)
+		if err != nil {
+			return nil, err
+		}
+
+		maxBodySize, spool, err := loadServerBody(serverData, name)
+		if err != nil {
+			return nil, err
+		}
+
+		cache, err := loadServerCache(serverData, name)
+		if err != nil {
+			return nil, err
+		}
+
 		return &ForwardServer{
-			Server: Server{
-				Name:           name,
-				ListenAddr:     listen,
-				MaxConnections: maxConnection,
-			},
+			Server:            server,
 			ID:                id,
 			LoadBalancer:      loadBalancer,
 			Forward:           forward,
 			UseForwarded:      useForwarded,
 			TimeoutPerRequest: timeout,
+			Sticky:            sticky,
+			HealthCheck:       healthCheck,
+			OutlierDetection:  outlierDetection,
+			Retry:             retry,
+			CircuitBreaker:    circuitBreaker,
+			Resolver:          resolver,
+			Discovery:         discovery,
+			Groups:            groups,
+			Split:             split,
+			Mirror:            mirror,
+			MaxConns:          maxConns,
+			Queue:             queue,
+			MaxBodySize:       maxBodySize,
+			Spool:             spool,
+			Cache:             cache,
 		}, nil
 	}
 	return nil, fmt.Errorf("wrong server %d configuration", index)
@@ -131,9 +288,15 @@ func loadServerServe(serverData map[string]any, name string) (string, bool, erro
 }
 
 func loadServerForward(serverData map[string]any, name string) ([]*Forward, LoadBalancer, error) {
+	if _, ok := serverData["discovery"]; ok {
+		if _, ok := serverData["forward"]; !ok {
+			return []*Forward{}, WeightedRoundRobin, nil
+		}
+	}
+
 	if forward, ok := serverData["forward"]; ok {
 		if addr, ok := forward.(string); ok {
-			return []*Forward{{Addr: addr}}, Base, nil
+			return []*Forward{{Addr: addr, Weight: 1}}, Base, nil
 		}
 		if forwards, ok := forward.([]any); ok {
 			return loadServerLoadBalancer(forwards, name)
@@ -148,7 +311,7 @@ func loadServerLoadBalancer(serverData []any, name string) ([]*Forward, LoadBala
 		forwards := make([]*Forward, len(serverData))
 		for i, forward := range serverData {
 			if addr, ok := forward.(string); ok {
-				forwards[i] = &Forward{Addr: addr}
+				forwards[i] = &Forward{Addr: addr, Weight: 1}
 			} else {
 				return nil, non, fmt.Errorf("forward %s must be all of the same type", name)
 			}
@@ -159,15 +322,56 @@ func loadServerLoadBalancer(serverData []any, name string) ([]*Forward, LoadBala
 		for i, v := range serverData {
 			if f, ok := v.(map[string]any); ok {
 				forward := &Forward{}
-				if addr, ok := f["addres"].(string); ok {
-					forward.Addr = addr
+				if addr, ok := f["addres"]; ok {
+					if addr, ok := addr.(string); ok {
+						forward.Addr = addr
+					} else {
+						return nil, non, fmt.Errorf("the address of forward %s %d must be string", name, i)
+					}
+				} else if host, ok := f["dns"]; ok {
+					if host, ok := host.(string); ok && host != "" {
+						forward.DNS = host
+					} else {
+						return nil, non, fmt.Errorf("the dns of forward %s %d must be string", name, i)
+					}
+				} else if service, ok := f["srv"]; ok {
+					if service, ok := service.(string); ok && service != "" {
+						forward.SRV = service
+					} else {
+						return nil, non, fmt.Errorf("the srv of forward %s %d must be string", name, i)
+					}
 				} else {
-					return nil, non, fmt.Errorf("the address of forward %s %d must be string", name, i)
+					return nil, non, fmt.Errorf("forward %s %d must have an addres, dns or srv", name, i)
 				}
-				if weight, ok := f["weight"].(int); ok {
-					forward.Weight = uint8(weight)
+				if weight, ok := f["weight"]; ok {
+					if weight, ok := weight.(int); ok && weight > 0 && weight <= 255 {
+						forward.Weight = uint8(weight)
+					} else {
+						return nil, non, fmt.Errorf("the Weight of forward %s %d must be integer", name, i)
+					}
 				} else {
-					return nil, non, fmt.Errorf("the Weight of forward %s %d must be integer", name, i)
+					forward.Weight = 1
+				}
+				if backup, ok := f["backup"]; ok {
+					if backup, ok := backup.(bool); ok {
+						forward.Backup = backup
+					} else {
+						return nil, non, fmt.Errorf("the backup of forward %s %d must be boolean", name, i)
+					}
+				}
+				if slowStart, ok := f["slow_start"]; ok {
+					if slowStart, ok := loadDuration(slowStart); ok {
+						forward.SlowStart = slowStart
+					} else {
+						return nil, non, fmt.Errorf("the slow_start of forward %s %d must be a duration", name, i)
+					}
+				}
+				if maxConns, ok := f["max_conns"]; ok {
+					if maxConns, ok := maxConns.(int); ok && maxConns > 0 {
+						forward.MaxConns = maxConns
+					} else {
+						return nil, non, fmt.Errorf("the max_conns of forward %s %d must be a positive int", name, i)
+					}
 				}
 				forwards[i] = forward
 			} else {
@@ -179,6 +383,200 @@ func loadServerLoadBalancer(serverData []any, name string) ([]*Forward, LoadBala
 	return nil, non, fmt.Errorf("forward of %s must be a string array or dict array", name)
 }
 
+// loadServerBalancer allows to replace the balancer deduced from the format
+// of the forward by any of the available balancers.
+func loadServerBalancer(
+	serverData map[string]any, name string, loadBalancer LoadBalancer,
+) (LoadBalancer, error) {
+	balancer, ok := serverData["balancer"]
+	if !ok {
+		return loadBalancer, nil
+	}
+
+	switch balancer {
+	case "round_robin":
+		return RoundRobin, nil
+	case "weighted_round_robin":
+		return WeightedRoundRobin, nil
+	case "p2c":
+		return PowerOfTwoChoices, nil
+	case "ewma":
+		return PeakEWMA, nil
+	}
+	return non, fmt.Errorf(
+		"balancer of %s must be round_robin, weighted_round_robin, p2c or ewma", name,
+	)
+}
+
+func loadServerGroups(
+	serverData map[string]any, name string, resolver *Resolver,
+) ([]*Group, error) {
+	groupsData, ok := serverData["groups"]
+	if !ok {
+		return nil, nil
+	}
+
+	for _, key := range []string{"forward", "balancer", "discovery"} {
+		if _, ok := serverData[key]; ok {
+			return nil, fmt.Errorf("%s of %s must be defined in its groups", key, name)
+		}
+	}
+
+	list, ok := groupsData.([]any)
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("groups of %s must be a non empty list", name)
+	}
+
+	names := make(map[string]bool, len(list))
+	totalWeight := 0
+	groups := make([]*Group, len(list))
+	for i, groupData := range list {
+		data, ok := groupData.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("group %d of %s must be a dict", i, name)
+		}
+
+		group := &Group{Resolver: resolver, Weight: 1}
+		if groupName, ok := data["name"].(string); ok && groupName != "" {
+			group.Name = groupName
+		} else {
+			return nil, fmt.Errorf("group %d of %s must have a name", i, name)
+		}
+		if names[group.Name] {
+			return nil, fmt.Errorf("group %s of %s is repeated", group.Name, name)
+		}
+		names[group.Name] = true
+
+		fullName := fmt.Sprintf("%s/%s", name, group.Name)
+		forward, loadBalancer, err := loadServerForward(data, fullName)
+		if err != nil {
+			return nil, err
+		}
+		group.Forward = forward
+
+		group.LoadBalancer, err = loadServerBalancer(data, fullName, loadBalancer)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := data["resolver"]; ok {
+			group.Resolver, err = loadServerResolver(data, fullName)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		group.Discovery, err = loadServerDiscovery(data, fullName)
+		if err != nil {
+			return nil, err
+		}
+
+		if weight, ok := data["weight"]; ok {
+			if weight, ok := weight.(int); ok && weight >= 0 {
+				group.Weight = weight
+			} else {
+				return nil, fmt.Errorf("weight of %s must be a non negative int", fullName)
+			}
+		}
+		totalWeight += group.Weight
+
+		group.Match, err = loadGroupMatch(data, fullName)
+		if err != nil {
+			return nil, err
+		}
+		groups[i] = group
+	}
+
+	if totalWeight == 0 {
+		return nil, fmt.Errorf("at least one group of %s must have weight", name)
+	}
+	return groups, nil
+}
+
+func loadGroupMatch(groupData map[string]any, name string) (*Match, error) {
+	matchData, ok := groupData["match"]
+	if !ok {
+		return nil, nil
+	}
+
+	data, ok := matchData.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("match of %s must be a dict", name)
+	}
+
+	match := &Match{}
+	for _, field := range []struct {
+		key   string
+		value *map[string]string
+	}{
+		{"header", &match.Header},
+		{"cookie", &match.Cookie},
+	} {
+		v, ok := data[field.key]
+		if !ok {
+			continue
+		}
+
+		values, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("match %s of %s must be a dict", field.key, name)
+		}
+		*field.value = make(map[string]string, len(values))
+		for key, value := range values {
+			switch value := value.(type) {
+			case string:
+				(*field.value)[key] = value
+			case int:
+				(*field.value)[key] = strconv.Itoa(value)
+			default:
+				return nil, fmt.Errorf(
+					"match %s %s of %s must be a string", field.key, key, name,
+				)
+			}
+		}
+	}
+
+	if len(match.Header) == 0 && len(match.Cookie) == 0 {
+		return nil, fmt.Errorf("match of %s must have a header or cookie", name)
+	}
+	return match, nil
+}
+
+func loadServerSplit(serverData map[string]any, name string, groups []*Group) (*Split, error) {
+	splitData, ok := serverData["split"]
+	if !ok {
+		return nil, nil
+	}
+	if groups == nil {
+		return nil, fmt.Errorf("split of %s requires groups", name)
+	}
+
+	data, ok := splitData.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("split of %s must be a dict", name)
+	}
+
+	hash, ok := data["hash"].(string)
+	if !ok {
+		return nil, fmt.Errorf("split of %s must have a hash", name)
+	}
+
+	split := &Split{}
+	switch {
+	case hash == "ip":
+		split.HashIP = true
+	case strings.HasPrefix(hash, "header:") && len(hash) > len("header:"):
+		split.HashHeader = strings.TrimPrefix(hash, "header:")
+	case strings.HasPrefix(hash, "cookie:") && len(hash) > len("cookie:"):
+		split.HashCookie = strings.TrimPrefix(hash, "cookie:")
+	default:
+		return nil, fmt.Errorf(
+			"split hash of %s must be ip, header:<name> or cookie:<name>", name,
+		)
+	}
+	return split, nil
+}
+
 func loadServerHeader(serverData map[string]any, name string) (bool, string, error) {
 	if header, ok := serverData["header"]; ok {
 		if header, ok := header.(string); ok {
@@ -247,6 +645,1769 @@ func loadServerConn(serverData map[string]any, name string) (time.Duration, int,
 	return timeout, maxConnections, nil
 }
 
+// loadServerClient reads the limits of the client connections, they are
+// part of the connection options.
+func loadServerClient(serverData map[string]any, name string) (ClientLimits, error) {
+	client := ClientLimits{
+		IdleTimeout:   60 * time.Second,
+		HeaderTimeout: 10 * time.Second,
+		MaxHeaderSize: 1 << 20,
+		MaxHeaders:    100,
+	}
+
+	conn, ok := serverData["connection"].(map[string]any)
+	if !ok {
+		return client, nil
+	}
+
+	for _, timeout := range []struct {
+		key   string
+		value *time.Duration
+	}{
+		{"idle_timeout", &client.IdleTimeout},
+		{"header_timeout", &client.HeaderTimeout},
+		{"body_timeout", &client.BodyTimeout},
+		{"write_timeout", &client.WriteTimeout},
+	} {
+		if value, ok := conn[timeout.key]; ok {
+			if value, ok := loadDuration(value); ok {
+				*timeout.value = value
+			} else {
+				return client, fmt.Errorf("%s of %s must be a duration", timeout.key, name)
+			}
+		}
+	}
+
+	if maxHeaderSize, ok := conn["max_header_size"]; ok {
+		if maxHeaderSize, ok := loadSize(maxHeaderSize); ok {
+			client.MaxHeaderSize = maxHeaderSize
+		} else {
+			return client, fmt.Errorf("max_header_size of %s must be a size", name)
+		}
+	}
+
+	if maxHeaders, ok := conn["max_headers"]; ok {
+		if maxHeaders, ok := maxHeaders.(int); ok && maxHeaders >= 0 {
+			client.MaxHeaders = maxHeaders
+		} else {
+			return client, fmt.Errorf("max_headers of %s must be a positive int", name)
+		}
+	}
+	return client, nil
+}
+
+// loadServerOverload reads the overload policy, it is part of the
+// connection options.
+func loadServerOverload(serverData map[string]any, name string) (Overload, error) {
+	overload := Overload{Policy: OverloadWait, RetryAfter: time.Second, QueueSize: 1024}
+
+	conn, ok := serverData["connection"].(map[string]any)
+	if !ok {
+		return overload, nil
+	}
+
+	if policy, ok := conn["overload"]; ok {
+		switch policy {
+		case "wait":
+		case "reject":
+			overload.Policy = OverloadReject
+		case "close":
+			overload.Policy = OverloadClose
+		default:
+			return overload, fmt.Errorf("overload of %s must be wait, reject or close", name)
+		}
+	}
+
+	if timeout, ok := conn["overload_timeout"]; ok {
+		if timeout, ok := loadDuration(timeout); ok {
+			overload.Timeout = timeout
+		} else {
+			return overload, fmt.Errorf("overload_timeout of %s must be a duration", name)
+		}
+	}
+
+	if queueSize, ok := conn["queue_size"]; ok {
+		if queueSize, ok := queueSize.(int); ok && queueSize > 0 {
+			overload.QueueSize = queueSize
+		} else {
+			return overload, fmt.Errorf("queue_size of %s must be a positive int", name)
+		}
+	}
+
+	if retryAfter, ok := conn["retry_after"]; ok {
+		if retryAfter, ok := loadDuration(retryAfter); ok {
+			overload.RetryAfter = retryAfter
+		} else {
+			return overload, fmt.Errorf("retry_after of %s must be a duration", name)
+		}
+	}
+	return overload, nil
+}
+
+func loadServerSticky(serverData map[string]any, name string) (*Sticky, error) {
+	stickyData, ok := serverData["sticky"]
+	if !ok {
+		return nil, nil
+	}
+
+	sticky := &Sticky{
+		CookieName: "grx_sticky",
+		Path:       "/",
+		HttpOnly:   true,
+		SameSite:   http.SameSiteLaxMode,
+	}
+	if enabled, ok := stickyData.(bool); ok {
+		if enabled {
+			return sticky, nil
+		}
+		return nil, nil
+	}
+
+	data, ok := stickyData.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("sticky of %s must be a boolean or dict", name)
+	}
+
+	if cookie, ok := data["cookie"]; ok {
+		if cookie, ok := cookie.(string); ok && cookie != "" {
+			sticky.CookieName = cookie
+		} else {
+			return nil, fmt.Errorf("sticky cookie of %s must be a non empty string", name)
+		}
+	}
+
+	if secret, ok := data["secret"]; ok {
+		if secret, ok := secret.(string); ok && secret != "" {
+			sticky.Secret = secret
+		} else {
+			return nil, fmt.Errorf("sticky secret of %s must be a non empty string", name)
+		}
+	}
+
+	if ttl, ok := data["ttl"]; ok {
+		if ttl, ok := loadDuration(ttl); ok {
+			sticky.TTL = ttl
+		} else {
+			return nil, fmt.Errorf("sticky ttl of %s must be a duration", name)
+		}
+	}
+
+	if path, ok := data["path"]; ok {
+		if path, ok := path.(string); ok {
+			sticky.Path = path
+		} else {
+			return nil, fmt.Errorf("sticky path of %s must be a string", name)
+		}
+	}
+
+	if secure, ok := data["secure"]; ok {
+		if secure, ok := secure.(bool); ok {
+			sticky.Secure = secure
+		} else {
+			return nil, fmt.Errorf("sticky secure of %s must be a boolean", name)
+		}
+	}
+
+	if httpOnly, ok := data["http_only"]; ok {
+		if httpOnly, ok := httpOnly.(bool); ok {
+			sticky.HttpOnly = httpOnly
+		} else {
+			return nil, fmt.Errorf("sticky http_only of %s must be a boolean", name)
+		}
+	}
+
+	if sameSite, ok := data["same_site"]; ok {
+		switch sameSite {
+		case "lax":
+			sticky.SameSite = http.SameSiteLaxMode
+		case "strict":
+			sticky.SameSite = http.SameSiteStrictMode
+		case "none":
+			sticky.SameSite = http.SameSiteNoneMode
+		default:
+			return nil, fmt.Errorf(
+				"sticky same_site of %s must be lax, strict or none", name,
+			)
+		}
+	}
+	return sticky, nil
+}
+
+func loadServerHealthCheck(serverData map[string]any, name string) (*HealthCheck, error) {
+	healthData, ok := serverData["health_check"]
+	if !ok {
+		return nil, nil
+	}
+
+	data, ok := healthData.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("health_check of %s must be a dict", name)
+	}
+
+	healthCheck := &HealthCheck{
+		Path:     "/",
+		Interval: 5 * time.Second,
+		Timeout:  2 * time.Second,
+		Rise:     2,
+		Fall:     3,
+	}
+
+	if t, ok := data["type"]; ok {
+		switch t {
+		case "http":
+		case "tcp":
+			healthCheck.TCP = true
+		default:
+			return nil, fmt.Errorf("health_check type of %s must be http or tcp", name)
+		}
+	}
+
+	if path, ok := data["path"]; ok {
+		if path, ok := path.(string); ok && strings.HasPrefix(path, "/") {
+			healthCheck.Path = path
+		} else {
+			return nil, fmt.Errorf("health_check path of %s must be an absolute path", name)
+		}
+	}
+
+	if status, ok := data["status"]; ok {
+		codes, ok := loadStatusCodes(status)
+		if !ok {
+			return nil, fmt.Errorf(
+				"health_check status of %s must be a status code or a list of them", name,
+			)
+		}
+		healthCheck.Status = codes
+	}
+
+	if body, ok := data["body"]; ok {
+		if body, ok := body.(string); ok {
+			healthCheck.Body = body
+		} else {
+			return nil, fmt.Errorf("health_check body of %s must be a string", name)
+		}
+	}
+
+	if interval, ok := data["interval"]; ok {
+		if interval, ok := loadDuration(interval); ok && interval > 0 {
+			healthCheck.Interval = interval
+		} else {
+			return nil, fmt.Errorf("health_check interval of %s must be a duration", name)
+		}
+	}
+
+	if timeout, ok := data["timeout"]; ok {
+		if timeout, ok := loadDuration(timeout); ok && timeout > 0 {
+			healthCheck.Timeout = timeout
+		} else {
+			return nil, fmt.Errorf("health_check timeout of %s must be a duration", name)
+		}
+	}
+
+	if rise, ok := data["rise"]; ok {
+		if rise, ok := rise.(int); ok && rise > 0 {
+			healthCheck.Rise = rise
+		} else {
+			return nil, fmt.Errorf("health_check rise of %s must be a positive int", name)
+		}
+	}
+
+	if fall, ok := data["fall"]; ok {
+		if fall, ok := fall.(int); ok && fall > 0 {
+			healthCheck.Fall = fall
+		} else {
+			return nil, fmt.Errorf("health_check fall of %s must be a positive int", name)
+		}
+	}
+	return healthCheck, nil
+}
+
+func loadServerOutlierDetection(
+	serverData map[string]any, name string,
+) (*OutlierDetection, error) {
+	outlierData, ok := serverData["outlier_detection"]
+	if !ok {
+		return nil, nil
+	}
+
+	data, ok := outlierData.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("outlier_detection of %s must be a dict", name)
+	}
+
+	outlierDetection := &OutlierDetection{
+		MaxFails:           5,
+		FailTimeout:        10 * time.Second,
+		Status:             []int{502, 503, 504},
+		EjectionTime:       30 * time.Second,
+		MaxEjectionTime:    5 * time.Minute,
+		MaxEjectionPercent: 50,
+	}
+
+	if maxFails, ok := data["max_fails"]; ok {
+		if maxFails, ok := maxFails.(int); ok && maxFails > 0 {
+			outlierDetection.MaxFails = maxFails
+		} else {
+			return nil, fmt.Errorf(
+				"outlier_detection max_fails of %s must be a positive int", name,
+			)
+		}
+	}
+
+	if failTimeout, ok := data["fail_timeout"]; ok {
+		if failTimeout, ok := loadDuration(failTimeout); ok && failTimeout > 0 {
+			outlierDetection.FailTimeout = failTimeout
+		} else {
+			return nil, fmt.Errorf(
+				"outlier_detection fail_timeout of %s must be a duration", name,
+			)
+		}
+	}
+
+	if status, ok := data["status"]; ok {
+		codes, ok := loadStatusCodes(status)
+		if !ok {
+			return nil, fmt.Errorf(
+				"outlier_detection status of %s must be a status code or a list of them", name,
+			)
+		}
+		outlierDetection.Status = codes
+	}
+
+	if ejectionTime, ok := data["ejection_time"]; ok {
+		if ejectionTime, ok := loadDuration(ejectionTime); ok && ejectionTime > 0 {
+			outlierDetection.EjectionTime = ejectionTime
+		} else {
+			return nil, fmt.Errorf(
+				"outlier_detection ejection_time of %s must be a duration", name,
+			)
+		}
+	}
+
+	if maxEjectionTime, ok := data["max_ejection_time"]; ok {
+		if maxEjectionTime, ok := loadDuration(maxEjectionTime); ok {
+			outlierDetection.MaxEjectionTime = maxEjectionTime
+		} else {
+			return nil, fmt.Errorf(
+				"outlier_detection max_ejection_time of %s must be a duration", name,
+			)
+		}
+	}
+	if outlierDetection.MaxEjectionTime < outlierDetection.EjectionTime {
+		return nil, fmt.Errorf(
+			"outlier_detection max_ejection_time of %s must be greater than ejection_time",
+			name,
+		)
+	}
+
+	if percent, ok := data["max_ejection_percent"]; ok {
+		if percent, ok := percent.(int); ok && percent >= 0 && percent <= 100 {
+			outlierDetection.MaxEjectionPercent = percent
+		} else {
+			return nil, fmt.Errorf(
+				"outlier_detection max_ejection_percent of %s must be between 0 and 100",
+				name,
+			)
+		}
+	}
+	return outlierDetection, nil
+}
+
+func loadServerRetry(serverData map[string]any, name string) (*Retry, error) {
+	retryData, ok := serverData["retry"]
+	if !ok {
+		return nil, nil
+	}
+
+	retry := &Retry{
+		Attempts:       2,
+		OnConnectError: true,
+		Budget:         20,
+		MinRetries:     10,
+	}
+	if attempts, ok := retryData.(int); ok {
+		if attempts < 1 {
+			return nil, fmt.Errorf("retry of %s must be a positive int", name)
+		}
+		retry.Attempts = attempts
+		return retry, nil
+	}
+
+	data, ok := retryData.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("retry of %s must be an int or dict", name)
+	}
+
+	if attempts, ok := data["attempts"]; ok {
+		if attempts, ok := attempts.(int); ok && attempts > 0 {
+			retry.Attempts = attempts
+		} else {
+			return nil, fmt.Errorf("retry attempts of %s must be a positive int", name)
+		}
+	}
+
+	if on, ok := data["on"]; ok {
+		conditions, ok := on.([]any)
+		if !ok {
+			return nil, fmt.Errorf("retry on of %s must be a list", name)
+		}
+
+		retry.OnConnectError = false
+		for _, condition := range conditions {
+			switch condition {
+			case "connect_error":
+				retry.OnConnectError = true
+			case "timeout":
+				retry.OnTimeout = true
+			default:
+				code, ok := condition.(int)
+				if !ok || code < 100 || code > 599 {
+					return nil, fmt.Errorf(
+						"retry on of %s must contain connect_error, timeout or status codes",
+						name,
+					)
+				}
+				retry.Status = append(retry.Status, code)
+			}
+		}
+	}
+
+	if nonIdempotent, ok := data["non_idempotent"]; ok {
+		if nonIdempotent, ok := nonIdempotent.(bool); ok {
+			retry.NonIdempotent = nonIdempotent
+		} else {
+			return nil, fmt.Errorf("retry non_idempotent of %s must be a boolean", name)
+		}
+	}
+
+	if tryTimeout, ok := data["try_timeout"]; ok {
+		if tryTimeout, ok := loadDuration(tryTimeout); ok {
+			retry.TryTimeout = tryTimeout
+		} else {
+			return nil, fmt.Errorf("retry try_timeout of %s must be a duration", name)
+		}
+	}
+
+	if budget, ok := data["budget"]; ok {
+		if budget, ok := budget.(int); ok && budget >= 0 && budget <= 100 {
+			retry.Budget = budget
+		} else {
+			return nil, fmt.Errorf("retry budget of %s must be between 0 and 100", name)
+		}
+	}
+
+	if minRetries, ok := data["min_retries"]; ok {
+		if minRetries, ok := minRetries.(int); ok && minRetries >= 0 {
+			retry.MinRetries = minRetries
+		} else {
+			return nil, fmt.Errorf("retry min_retries of %s must be a positive int", name)
+		}
+	}
+	return retry, nil
+}
+
+func loadServerCircuitBreaker(
+	serverData map[string]any, name string,
+) (*CircuitBreaker, error) {
+	breakerData, ok := serverData["circuit_breaker"]
+	if !ok {
+		return nil, nil
+	}
+
+	data, ok := breakerData.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("circuit_breaker of %s must be a dict", name)
+	}
+
+	circuitBreaker := &CircuitBreaker{
+		ConsecutiveFailures: 5,
+		ErrorRate:           50,
+		MinRequests:         20,
+		Window:              10 * time.Second,
+		OpenTime:            30 * time.Second,
+		HalfOpenRequests:    3,
+		Status:              []int{500, 502, 503, 504},
+	}
+
+	if failures, ok := data["consecutive_failures"]; ok {
+		if failures, ok := failures.(int); ok && failures >= 0 {
+			circuitBreaker.ConsecutiveFailures = failures
+		} else {
+			return nil, fmt.Errorf(
+				"circuit_breaker consecutive_failures of %s must be a positive int", name,
+			)
+		}
+	}
+
+	if errorRate, ok := data["error_rate"]; ok {
+		if errorRate, ok := errorRate.(int); ok && errorRate >= 1 && errorRate <= 100 {
+			circuitBreaker.ErrorRate = errorRate
+		} else {
+			return nil, fmt.Errorf(
+				"circuit_breaker error_rate of %s must be between 1 and 100", name,
+			)
+		}
+	}
+
+	if minRequests, ok := data["min_requests"]; ok {
+		if minRequests, ok := minRequests.(int); ok && minRequests > 0 {
+			circuitBreaker.MinRequests = minRequests
+		} else {
+			return nil, fmt.Errorf(
+				"circuit_breaker min_requests of %s must be a positive int", name,
+			)
+		}
+	}
+
+	if window, ok := data["window"]; ok {
+		if window, ok := loadDuration(window); ok && window > 0 {
+			circuitBreaker.Window = window
+		} else {
+			return nil, fmt.Errorf("circuit_breaker window of %s must be a duration", name)
+		}
+	}
+
+	if openTime, ok := data["open_time"]; ok {
+		if openTime, ok := loadDuration(openTime); ok && openTime > 0 {
+			circuitBreaker.OpenTime = openTime
+		} else {
+			return nil, fmt.Errorf(
+				"circuit_breaker open_time of %s must be a duration", name,
+			)
+		}
+	}
+
+	if probes, ok := data["half_open_requests"]; ok {
+		if probes, ok := probes.(int); ok && probes > 0 {
+			circuitBreaker.HalfOpenRequests = probes
+		} else {
+			return nil, fmt.Errorf(
+				"circuit_breaker half_open_requests of %s must be a positive int", name,
+			)
+		}
+	}
+
+	if status, ok := data["status"]; ok {
+		codes, ok := loadStatusCodes(status)
+		if !ok {
+			return nil, fmt.Errorf(
+				"circuit_breaker status of %s must be a status code or a list of them", name,
+			)
+		}
+		circuitBreaker.Status = codes
+	}
+	return circuitBreaker, nil
+}
+
+func loadServerResolver(serverData map[string]any, name string) (*Resolver, error) {
+	resolver := &Resolver{Interval: 30 * time.Second}
+
+	resolverData, ok := serverData["resolver"]
+	if !ok {
+		return resolver, nil
+	}
+
+	if addr, ok := resolverData.(string); ok {
+		resolver.Addr = addr
+		return resolver, nil
+	}
+
+	data, ok := resolverData.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("resolver of %s must be a string or dict", name)
+	}
+
+	if addr, ok := data["addr"]; ok {
+		if addr, ok := addr.(string); ok {
+			resolver.Addr = addr
+		} else {
+			return nil, fmt.Errorf("resolver addr of %s must be a string", name)
+		}
+	}
+
+	if interval, ok := data["interval"]; ok {
+		if interval, ok := loadDuration(interval); ok && interval >= time.Second {
+			resolver.Interval = interval
+		} else {
+			return nil, fmt.Errorf(
+				"resolver interval of %s must be a duration of at least 1s", name,
+			)
+		}
+	}
+	return resolver, nil
+}
+
+func loadServerDiscovery(serverData map[string]any, name string) (*Discovery, error) {
+	discoveryData, ok := serverData["discovery"]
+	if !ok {
+		return nil, nil
+	}
+
+	discovery := &Discovery{Interval: 5 * time.Second}
+	if source, ok := discoveryData.(string); ok {
+		if path := strings.TrimPrefix(source, "file:"); path != source && path != "" {
+			discovery.File = path
+			return discovery, nil
+		}
+		if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+			discovery.URL = source
+			return discovery, nil
+		}
+		return nil, fmt.Errorf("discovery of %s must be file:<path> or an url", name)
+	}
+
+	data, ok := discoveryData.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("discovery of %s must be a string or dict", name)
+	}
+
+	if file, ok := data["file"]; ok {
+		if file, ok := file.(string); ok && file != "" {
+			discovery.File = file
+		} else {
+			return nil, fmt.Errorf("discovery file of %s must be a string", name)
+		}
+	}
+
+	if url, ok := data["url"]; ok {
+		if url, ok := url.(string); ok && url != "" {
+			discovery.URL = url
+		} else {
+			return nil, fmt.Errorf("discovery url of %s must be a string", name)
+		}
+	}
+
+	if (discovery.File == "") == (discovery.URL == "") {
+		return nil, fmt.Errorf("discovery of %s must have a file or an url", name)
+	}
+
+	if interval, ok := data["interval"]; ok {
+		if interval, ok := loadDuration(interval); ok && interval > 0 {
+			discovery.Interval = interval
+		} else {
+			return nil, fmt.Errorf("discovery interval of %s must be a duration", name)
+		}
+	}
+
+	if longPoll, ok := data["long_poll"]; ok {
+		if longPoll, ok := longPoll.(bool); ok {
+			discovery.LongPoll = longPoll
+		} else {
+			return nil, fmt.Errorf("discovery long_poll of %s must be a boolean", name)
+		}
+	}
+
+	if format, ok := data["format"]; ok {
+		switch format {
+		case "grx":
+		case "consul":
+			discovery.Mapping = &DiscoveryMapping{
+				Address: []string{"ServiceAddress", "Address"},
+				Port:    "ServicePort",
+				Weight:  "ServiceWeights.Passing",
+			}
+		case "consul_health":
+			discovery.Mapping = &DiscoveryMapping{
+				Address: []string{"Service.Address", "Node.Address"},
+				Port:    "Service.Port",
+				Weight:  "Service.Weights.Passing",
+				Checks:  "Checks",
+			}
+		default:
+			return nil, fmt.Errorf(
+				"discovery format of %s must be grx, consul or consul_health", name,
+			)
+		}
+	}
+
+	if mappingData, ok := data["mapping"]; ok {
+		mapping, err := loadDiscoveryMapping(mappingData, name)
+		if err != nil {
+			return nil, err
+		}
+		discovery.Mapping = mapping
+	}
+	return discovery, nil
+}
+
+func loadDiscoveryMapping(mappingData any, name string) (*DiscoveryMapping, error) {
+	data, ok := mappingData.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("discovery mapping of %s must be a dict", name)
+	}
+
+	mapping := &DiscoveryMapping{}
+	for _, field := range []struct {
+		key   string
+		value *string
+	}{
+		{"list", &mapping.List},
+		{"port", &mapping.Port},
+		{"weight", &mapping.Weight},
+		{"checks", &mapping.Checks},
+	} {
+		if v, ok := data[field.key]; ok {
+			if v, ok := v.(string); ok {
+				*field.value = v
+			} else {
+				return nil, fmt.Errorf(
+					"discovery mapping %s of %s must be a string", field.key, name,
+				)
+			}
+		}
+	}
+
+	switch address := data["address"].(type) {
+	case string:
+		mapping.Address = []string{address}
+	case []any:
+		for _, v := range address {
+			if v, ok := v.(string); ok {
+				mapping.Address = append(mapping.Address, v)
+			} else {
+				return nil, fmt.Errorf(
+					"discovery mapping address of %s must be a string or list of strings",
+					name,
+				)
+			}
+		}
+	}
+	if len(mapping.Address) == 0 {
+		return nil, fmt.Errorf("discovery mapping of %s must have an address", name)
+	}
+	return mapping, nil
+}
+
+func loadServerBody(serverData map[string]any, name string) (int64, *Spool, error) {
+	var maxBodySize int64
+	if value, ok := serverData["max_body_size"]; ok {
+		if value, ok := loadSize(value); ok && value > 0 {
+			maxBodySize = value
+		} else {
+			return 0, nil, fmt.Errorf("max_body_size of %s must be a positive size", name)
+		}
+	}
+
+	spoolData, ok := serverData["spool"]
+	if !ok {
+		return maxBodySize, nil, nil
+	}
+
+	spool := &Spool{MemorySize: 64 << 10}
+	if enabled, ok := spoolData.(bool); ok {
+		if !enabled {
+			return maxBodySize, nil, nil
+		}
+		return maxBodySize, spool, nil
+	}
+
+	data, ok := spoolData.(map[string]any)
+	if !ok {
+		return 0, nil, fmt.Errorf("spool of %s must be a boolean or dict", name)
+	}
+
+	if memorySize, ok := data["memory_size"]; ok {
+		if memorySize, ok := loadSize(memorySize); ok {
+			spool.MemorySize = memorySize
+		} else {
+			return 0, nil, fmt.Errorf("spool memory_size of %s must be a size", name)
+		}
+	}
+
+	if dir, ok := data["dir"]; ok {
+		if dir, ok := dir.(string); ok {
+			spool.Dir = dir
+		} else {
+			return 0, nil, fmt.Errorf("spool dir of %s must be a string", name)
+		}
+	}
+	return maxBodySize, spool, nil
+}
+
+func loadServerCache(serverData map[string]any, name string) (*Cache, error) {
+	cacheData, ok := serverData["cache"]
+	if !ok {
+		return nil, nil
+	}
+
+	cache := &Cache{
+		MaxSize:      64 << 20,
+		MaxEntrySize: 1 << 20,
+		Key:          []string{"host", "path", "query"},
+	}
+	if enabled, ok := cacheData.(bool); ok {
+		if !enabled {
+			return nil, nil
+		}
+		return cache, nil
+	}
+
+	data, ok := cacheData.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("cache of %s must be a boolean or dict", name)
+	}
+
+	for _, size := range []struct {
+		key   string
+		value *int64
+	}{
+		{"max_size", &cache.MaxSize},
+		{"max_entry_size", &cache.MaxEntrySize},
+	} {
+		value, ok := data[size.key]
+		if !ok {
+			continue
+		}
+		if value, ok := loadSize(value); ok && value > 0 {
+			*size.value = value
+		} else {
+			return nil, fmt.Errorf("cache %s of %s must be a positive size", size.key, name)
+		}
+	}
+	if cache.MaxEntrySize > cache.MaxSize {
+		return nil, fmt.Errorf("cache max_entry_size of %s can not exceed max_size", name)
+	}
+
+	if key, ok := data["key"]; ok {
+		parts, ok := key.([]any)
+		if !ok || len(parts) == 0 {
+			return nil, fmt.Errorf("cache key of %s must be a list", name)
+		}
+		cache.Key = nil
+		for _, part := range parts {
+			part, _ := part.(string)
+			switch {
+			case part == "host", part == "path", part == "query":
+			case strings.HasPrefix(part, "header:") && len(part) > len("header:"):
+				part = "header:" + http.CanonicalHeaderKey(part[len("header:"):])
+			case strings.HasPrefix(part, "cookie:") && len(part) > len("cookie:"):
+			default:
+				return nil, fmt.Errorf("cache key %q of %s is not valid", part, name)
+			}
+			cache.Key = append(cache.Key, part)
+		}
+	}
+
+	if defaultTTL, ok := data["default_ttl"]; ok {
+		cache.DefaultTTL, ok = loadDuration(defaultTTL)
+		if !ok {
+			return nil, fmt.Errorf("cache default_ttl of %s is not valid", name)
+		}
+	}
+	return cache, nil
+}
+
+func loadServerAccess(serverData map[string]any, name string) (*Access, error) {
+	accessData, ok := serverData["access"]
+	if !ok {
+		return nil, nil
+	}
+
+	data, ok := accessData.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("access of %s must be a dict", name)
+	}
+
+	access := &Access{}
+	if action, ok := data["action"]; ok {
+		switch action {
+		case "forbidden":
+		case "drop":
+			access.Drop = true
+		default:
+			return nil, fmt.Errorf("access action of %s must be forbidden or drop", name)
+		}
+	}
+
+	rules, ok := data["rules"].([]any)
+	if !ok || len(rules) == 0 {
+		return nil, fmt.Errorf("access of %s must have a list of rules", name)
+	}
+
+	for i, ruleData := range rules {
+		rule, ok := ruleData.(map[string]any)
+		if !ok || len(rule) != 1 {
+			return nil, fmt.Errorf("access rule %d of %s must have a single key", i, name)
+		}
+
+		for key, value := range rule {
+			accessRule := &AccessRule{}
+			var err error
+			switch key {
+			case "allow", "deny":
+				accessRule.Prefixes, err = loadAccessPrefixes(value)
+			case "allow_file", "deny_file":
+				path, _ := value.(string)
+				accessRule.Prefixes, err = loadAccessFile(path)
+			default:
+				err = fmt.Errorf("unknown key %s", key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("access rule %d of %s: %w", i, name, err)
+			}
+			accessRule.Allow = strings.HasPrefix(key, "allow")
+			access.Rules = append(access.Rules, accessRule)
+		}
+	}
+	return access, nil
+}
+
+// loadAccessPrefixes accepts a network, an IP or "all", or a list of them.
+func loadAccessPrefixes(value any) ([]netip.Prefix, error) {
+	values, ok := value.([]any)
+	if !ok {
+		values = []any{value}
+	}
+
+	var prefixes []netip.Prefix
+	for _, value := range values {
+		value, ok := value.(string)
+		if !ok {
+			return nil, errors.New("the networks must be strings")
+		}
+		if value == "all" {
+			prefixes = append(prefixes, netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0"))
+			continue
+		}
+		prefix, err := parsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// loadAccessFile reads a file with a network or IP per line, the empty
+// lines and the comments starting with # are ignored.
+func loadAccessFile(path string) ([]netip.Prefix, error) {
+	if path == "" {
+		return nil, errors.New("the file must be a string")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var prefixes []netip.Prefix
+	for i, line := range strings.Split(string(data), "\n") {
+		if comment := strings.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		prefix, err := parsePrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d of %s: %w", i+1, path, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+func loadServerBasicAuth(serverData map[string]any, name string) (*BasicAuth, error) {
+	basicAuthData, ok := serverData["basic_auth"]
+	if !ok {
+		return nil, nil
+	}
+
+	data, ok := basicAuthData.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("basic_auth of %s must be a dict", name)
+	}
+
+	basicAuth := &BasicAuth{Realm: name, MaxFailures: 5, Lockout: 5 * time.Minute}
+	file, ok := data["file"].(string)
+	if !ok || file == "" {
+		return nil, fmt.Errorf("basic_auth of %s must have a file", name)
+	}
+	if _, err := os.Stat(file); err != nil {
+		return nil, fmt.Errorf("basic_auth file of %s: %w", name, err)
+	}
+	basicAuth.File = file
+
+	if realm, ok := data["realm"]; ok {
+		realm, ok := realm.(string)
+		if !ok || realm == "" || strings.ContainsRune(realm, '"') {
+			return nil, fmt.Errorf("basic_auth realm of %s is not valid", name)
+		}
+		basicAuth.Realm = realm
+	}
+
+	if strip, ok := data["strip_header"]; ok {
+		basicAuth.StripHeader, ok = strip.(bool)
+		if !ok {
+			return nil, fmt.Errorf("basic_auth strip_header of %s must be a boolean", name)
+		}
+	}
+
+	if maxFailures, ok := data["max_failures"]; ok {
+		basicAuth.MaxFailures, ok = maxFailures.(int)
+		if !ok || basicAuth.MaxFailures < 0 {
+			return nil, fmt.Errorf("basic_auth max_failures of %s is not valid", name)
+		}
+	}
+
+	if lockout, ok := data["lockout"]; ok {
+		basicAuth.Lockout, ok = loadDuration(lockout)
+		if !ok || basicAuth.Lockout == 0 {
+			return nil, fmt.Errorf("basic_auth lockout of %s is not valid", name)
+		}
+	}
+	return basicAuth, nil
+}
+
+func loadServerJWT(serverData map[string]any, name string) (*JWT, error) {
+	jwtData, ok := serverData["jwt"]
+	if !ok {
+		return nil, nil
+	}
+
+	data, ok := jwtData.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("jwt of %s must be a dict", name)
+	}
+
+	jwt := &JWT{
+		Realm:      name,
+		Refresh:    10 * time.Minute,
+		ClockSkew:  30 * time.Second,
+		RequireExp: true,
+	}
+	jwt.JWKSFile, _ = data["jwks_file"].(string)
+	jwt.JWKSURL, _ = data["jwks_url"].(string)
+	if (jwt.JWKSFile == "") == (jwt.JWKSURL == "") {
+		return nil, fmt.Errorf("jwt of %s must have either jwks_file or jwks_url", name)
+	}
+	if jwt.JWKSURL != "" {
+		if u, err := url.Parse(jwt.JWKSURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("jwt jwks_url of %s is not valid", name)
+		}
+	}
+
+	if realm, ok := data["realm"]; ok {
+		realm, ok := realm.(string)
+		if !ok || realm == "" || strings.ContainsRune(realm, '"') {
+			return nil, fmt.Errorf("jwt realm of %s is not valid", name)
+		}
+		jwt.Realm = realm
+	}
+
+	for _, duration := range []struct {
+		key   string
+		value *time.Duration
+	}{
+		{"refresh", &jwt.Refresh},
+		{"clock_skew", &jwt.ClockSkew},
+	} {
+		value, ok := data[duration.key]
+		if !ok {
+			continue
+		}
+		if *duration.value, ok = loadDuration(value); !ok {
+			return nil, fmt.Errorf("jwt %s of %s is not valid", duration.key, name)
+		}
+	}
+	if jwt.Refresh == 0 {
+		return nil, fmt.Errorf("jwt refresh of %s is not valid", name)
+	}
+
+	if requireExp, ok := data["require_exp"]; ok {
+		if jwt.RequireExp, ok = requireExp.(bool); !ok {
+			return nil, fmt.Errorf("jwt require_exp of %s must be a boolean", name)
+		}
+	}
+
+	if issuer, ok := data["issuer"]; ok {
+		if jwt.Issuer, ok = issuer.(string); !ok {
+			return nil, fmt.Errorf("jwt issuer of %s must be a string", name)
+		}
+	}
+
+	for _, list := range []struct {
+		key   string
+		value *[]string
+	}{
+		{"audience", &jwt.Audience},
+		{"required_claims", &jwt.RequiredClaims},
+	} {
+		value, ok := data[list.key]
+		if !ok {
+			continue
+		}
+		values, ok := value.([]any)
+		if !ok {
+			values = []any{value}
+		}
+		for _, value := range values {
+			value, ok := value.(string)
+			if !ok || value == "" {
+				return nil, fmt.Errorf("jwt %s of %s must be strings", list.key, name)
+			}
+			*list.value = append(*list.value, value)
+		}
+	}
+
+	if headers, ok := data["headers"]; ok {
+		headers, ok := headers.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("jwt headers of %s must be a dict", name)
+		}
+		jwt.Headers = make(map[string]string, len(headers))
+		for header, claim := range headers {
+			claim, ok := claim.(string)
+			if !ok || claim == "" {
+				return nil, fmt.Errorf("jwt header %s of %s must be a claim", header, name)
+			}
+			jwt.Headers[http.CanonicalHeaderKey(header)] = claim
+		}
+	}
+	return jwt, nil
+}
+
+func loadServerAuthRequest(serverData map[string]any, name string) (*AuthRequest, error) {
+	authRequestData, ok := serverData["auth_request"]
+	if !ok {
+		return nil, nil
+	}
+
+	data, ok := authRequestData.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("auth_request of %s must be a dict", name)
+	}
+
+	authRequest := &AuthRequest{
+		Headers: []string{"Authorization", "Cookie"},
+		Timeout: 5 * time.Second,
+	}
+	for _, address := range []struct {
+		key   string
+		value *string
+	}{
+		{"url", &authRequest.URL},
+		{"login_url", &authRequest.LoginURL},
+	} {
+		value, ok := data[address.key]
+		if !ok {
+			continue
+		}
+		raw, _ := value.(string)
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("auth_request %s of %s is not valid", address.key, name)
+		}
+		*address.value = u.String()
+	}
+	if authRequest.URL == "" {
+		return nil, fmt.Errorf("auth_request of %s must have a url", name)
+	}
+
+	for _, list := range []struct {
+		key   string
+		value *[]string
+	}{
+		{"headers", &authRequest.Headers},
+		{"response_headers", &authRequest.ResponseHeaders},
+	} {
+		value, ok := data[list.key]
+		if !ok {
+			continue
+		}
+		values, ok := value.([]any)
+		if !ok {
+			return nil, fmt.Errorf("auth_request %s of %s must be a list", list.key, name)
+		}
+		*list.value = nil
+		for _, value := range values {
+			value, ok := value.(string)
+			if !ok || value == "" {
+				return nil, fmt.Errorf("auth_request %s of %s must be strings", list.key, name)
+			}
+			*list.value = append(*list.value, http.CanonicalHeaderKey(value))
+		}
+	}
+
+	for _, duration := range []struct {
+		key   string
+		value *time.Duration
+	}{
+		{"cache", &authRequest.CacheTTL},
+		{"timeout", &authRequest.Timeout},
+	} {
+		value, ok := data[duration.key]
+		if !ok {
+			continue
+		}
+		if *duration.value, ok = loadDuration(value); !ok {
+			return nil, fmt.Errorf("auth_request %s of %s is not valid", duration.key, name)
+		}
+	}
+	if authRequest.Timeout == 0 {
+		return nil, fmt.Errorf("auth_request timeout of %s is not valid", name)
+	}
+	return authRequest, nil
+}
+
+func loadServerFilter(serverData map[string]any, name string) (*Filter, error) {
+	filterData, ok := serverData["filter"]
+	if !ok {
+		return nil, nil
+	}
+
+	data, ok := filterData.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("filter of %s must be a dict", name)
+	}
+
+	filter := &Filter{}
+	if methods, ok := data["methods"]; ok {
+		list, ok := methods.([]any)
+		if !ok || len(list) == 0 {
+			return nil, fmt.Errorf("filter methods of %s must be a list", name)
+		}
+		for _, method := range list {
+			method, ok := method.(string)
+			if !ok || method == "" {
+				return nil, fmt.Errorf("filter methods of %s must be strings", name)
+			}
+			filter.Methods = append(filter.Methods, strings.ToUpper(method))
+		}
+	}
+
+	if maxURLLength, ok := data["max_url_length"]; ok {
+		filter.MaxURLLength, ok = maxURLLength.(int)
+		if !ok || filter.MaxURLLength < 0 {
+			return nil, fmt.Errorf("filter max_url_length of %s is not valid", name)
+		}
+	}
+
+	if blockData, ok := data["block"]; ok {
+		block, ok := blockData.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("filter block of %s must be a dict", name)
+		}
+		for key, value := range block {
+			var err error
+			switch key {
+			case "path":
+				filter.Path, err = loadPatterns(value)
+			case "query":
+				filter.Query, err = loadPatterns(value)
+			case "user_agent":
+				filter.UserAgent, err = loadPatterns(value)
+			case "headers":
+				headers, ok := value.(map[string]any)
+				if !ok {
+					return nil, fmt.Errorf("filter block headers of %s must be a dict", name)
+				}
+				filter.Headers = make(map[string][]*regexp.Regexp, len(headers))
+				for header, value := range headers {
+					patterns, err := loadPatterns(value)
+					if err != nil {
+						return nil, fmt.Errorf("filter block header %s of %s: %w", header, name, err)
+					}
+					filter.Headers[http.CanonicalHeaderKey(header)] = patterns
+				}
+			default:
+				return nil, fmt.Errorf("filter block of %s has an unknown key %s", name, key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("filter block %s of %s: %w", key, name, err)
+			}
+		}
+	}
+
+	if signatures, ok := data["signatures"]; ok {
+		list, ok := signatures.([]any)
+		if !ok {
+			return nil, fmt.Errorf("filter signatures of %s must be a list", name)
+		}
+		for _, signature := range list {
+			switch signature {
+			case "path_traversal", "sql_injection":
+				filter.Signatures = append(filter.Signatures, signature.(string))
+			default:
+				return nil, fmt.Errorf("filter signature %v of %s is not valid", signature, name)
+			}
+		}
+	}
+
+	if detectOnly, ok := data["detect_only"]; ok {
+		filter.DetectOnly, ok = detectOnly.(bool)
+		if !ok {
+			return nil, fmt.Errorf("filter detect_only of %s must be a boolean", name)
+		}
+	}
+	return filter, nil
+}
+
+func loadServerCORS(serverData map[string]any, name string) (*CORS, error) {
+	corsData, ok := serverData["cors"]
+	if !ok {
+		return nil, nil
+	}
+
+	data, ok := corsData.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("cors of %s must be a dict", name)
+	}
+
+	cors := &CORS{Methods: []string{http.MethodGet, http.MethodHead, http.MethodPost}}
+	for _, list := range []struct {
+		key   string
+		value *[]string
+	}{
+		{"origins", &cors.Origins},
+		{"methods", &cors.Methods},
+		{"headers", &cors.Headers},
+		{"expose_headers", &cors.ExposeHeaders},
+	} {
+		value, ok := data[list.key]
+		if !ok {
+			continue
+		}
+		values, ok := value.([]any)
+		if !ok {
+			values = []any{value}
+		}
+		*list.value = nil
+		for _, value := range values {
+			value, ok := value.(string)
+			if !ok || value == "" {
+				return nil, fmt.Errorf("cors %s of %s must be strings", list.key, name)
+			}
+			*list.value = append(*list.value, value)
+		}
+	}
+	for i, method := range cors.Methods {
+		cors.Methods[i] = strings.ToUpper(method)
+	}
+	for i, origin := range cors.Origins {
+		origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+		if strings.Count(origin, "*") > 1 ||
+			(origin != "*" && strings.Contains(origin, "*") && !strings.Contains(origin, "*.")) {
+			return nil, fmt.Errorf("cors origin %s of %s is not valid", origin, name)
+		}
+		cors.Origins[i] = origin
+	}
+
+	if patterns, ok := data["origin_patterns"]; ok {
+		var err error
+		if cors.OriginPatterns, err = loadPatterns(patterns); err != nil {
+			return nil, fmt.Errorf("cors origin_patterns of %s: %w", name, err)
+		}
+	}
+	if cors.Origins == nil && cors.OriginPatterns == nil {
+		return nil, fmt.Errorf("cors of %s must have origins or origin_patterns", name)
+	}
+
+	if credentials, ok := data["credentials"]; ok {
+		cors.Credentials, ok = credentials.(bool)
+		if !ok {
+			return nil, fmt.Errorf("cors credentials of %s must be a boolean", name)
+		}
+	}
+	// Any site could read the responses with the credentials of the users.
+	if cors.Credentials {
+		for _, origin := range cors.Origins {
+			if origin == "*" {
+				return nil, fmt.Errorf("cors of %s can not allow any origin with credentials", name)
+			}
+		}
+	}
+
+	if maxAge, ok := data["max_age"]; ok {
+		cors.MaxAge, ok = loadDuration(maxAge)
+		if !ok {
+			return nil, fmt.Errorf("cors max_age of %s is not valid", name)
+		}
+	}
+
+	if mode, ok := data["mode"]; ok {
+		switch mode {
+		case "override":
+		case "merge":
+			cors.Merge = true
+		default:
+			return nil, fmt.Errorf("cors mode of %s must be override or merge", name)
+		}
+	}
+	return cors, nil
+}
+
+// loadPatterns accepts a regular expression or a list of them.
+func loadPatterns(value any) ([]*regexp.Regexp, error) {
+	values, ok := value.([]any)
+	if !ok {
+		values = []any{value}
+	}
+
+	patterns := make([]*regexp.Regexp, 0, len(values))
+	for _, value := range values {
+		value, ok := value.(string)
+		if !ok || value == "" {
+			return nil, errors.New("the patterns must be strings")
+		}
+		pattern, err := regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+func loadServerPerClient(serverData map[string]any, name string) (*PerClient, error) {
+	perClientData, ok := serverData["per_client"]
+	if !ok {
+		return nil, nil
+	}
+
+	data, ok := perClientData.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("per_client of %s must be a dict", name)
+	}
+
+	perClient := &PerClient{IPv4Prefix: 24, IPv6Prefix: 64}
+	for _, limit := range []struct {
+		key   string
+		value *int
+		max   int
+	}{
+		{"connections", &perClient.Connections, 0},
+		{"requests", &perClient.Requests, 0},
+		{"prefix_connections", &perClient.PrefixConnections, 0},
+		{"prefix_requests", &perClient.PrefixRequests, 0},
+		{"ipv4_prefix", &perClient.IPv4Prefix, 32},
+		{"ipv6_prefix", &perClient.IPv6Prefix, 128},
+	} {
+		value, ok := data[limit.key]
+		if !ok {
+			continue
+		}
+		if value, ok := value.(int); ok && value >= 0 && (limit.max == 0 || value <= limit.max) {
+			*limit.value = value
+		} else {
+			return nil, fmt.Errorf("per_client %s of %s is not valid", limit.key, name)
+		}
+	}
+
+	if allow, ok := data["allow"]; ok {
+		list, ok := allow.([]any)
+		if !ok {
+			return nil, fmt.Errorf("per_client allow of %s must be a list", name)
+		}
+		for _, value := range list {
+			value, _ := value.(string)
+			prefix, err := parsePrefix(value)
+			if err != nil {
+				return nil, fmt.Errorf("per_client allow of %s: %w", name, err)
+			}
+			perClient.Allow = append(perClient.Allow, prefix)
+		}
+	}
+	return perClient, nil
+}
+
+func loadServerRateLimit(serverData map[string]any, name string) (*RateLimit, error) {
+	rateLimitData, ok := serverData["rate_limit"]
+	if !ok {
+		return nil, nil
+	}
+
+	data, ok := rateLimitData.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("rate_limit of %s must be a dict", name)
+	}
+
+	rateLimit := &RateLimit{Period: time.Second, MaxKeys: 10000}
+	if key, ok := data["key"]; ok {
+		key, _ := key.(string)
+		switch {
+		case key == "ip":
+		case key == "server":
+			rateLimit.KeyServer = true
+		case strings.HasPrefix(key, "header:") && len(key) > len("header:"):
+			rateLimit.KeyHeader = strings.TrimPrefix(key, "header:")
+		default:
+			return nil, fmt.Errorf(
+				"rate_limit key of %s must be ip, header:<name> or server", name,
+			)
+		}
+	}
+
+	if algorithm, ok := data["algorithm"]; ok {
+		switch algorithm {
+		case "token_bucket":
+		case "sliding_window":
+			rateLimit.SlidingWindow = true
+		default:
+			return nil, fmt.Errorf(
+				"rate_limit algorithm of %s must be token_bucket or sliding_window", name,
+			)
+		}
+	}
+
+	if rate, ok := data["rate"].(int); ok && rate > 0 {
+		rateLimit.Rate = rate
+	} else {
+		return nil, fmt.Errorf("rate_limit of %s must have a positive int rate", name)
+	}
+	rateLimit.Burst = rateLimit.Rate
+
+	if period, ok := data["period"]; ok {
+		if period, ok := loadDuration(period); ok && period > 0 {
+			rateLimit.Period = period
+		} else {
+			return nil, fmt.Errorf("rate_limit period of %s must be a positive duration", name)
+		}
+	}
+
+	if burst, ok := data["burst"]; ok {
+		if burst, ok := burst.(int); ok && burst > 0 {
+			rateLimit.Burst = burst
+		} else {
+			return nil, fmt.Errorf("rate_limit burst of %s must be a positive int", name)
+		}
+	}
+
+	if delay, ok := data["delay"]; ok {
+		if delay, ok := loadDuration(delay); ok {
+			rateLimit.Delay = delay
+		} else {
+			return nil, fmt.Errorf("rate_limit delay of %s must be a duration", name)
+		}
+	}
+
+	if maxKeys, ok := data["max_keys"]; ok {
+		if maxKeys, ok := maxKeys.(int); ok && maxKeys > 0 {
+			rateLimit.MaxKeys = maxKeys
+		} else {
+			return nil, fmt.Errorf("rate_limit max_keys of %s must be a positive int", name)
+		}
+	}
+	return rateLimit, nil
+}
+
+func loadServerQueue(serverData map[string]any, name string) (int, *Queue, error) {
+	var maxConns int
+	if value, ok := serverData["max_conns"]; ok {
+		if value, ok := value.(int); ok && value > 0 {
+			maxConns = value
+		} else {
+			return 0, nil, fmt.Errorf("max_conns of %s must be a positive int", name)
+		}
+	}
+
+	queueData, ok := serverData["queue"]
+	if !ok {
+		return maxConns, nil, nil
+	}
+
+	data, ok := queueData.(map[string]any)
+	if !ok {
+		return 0, nil, fmt.Errorf("queue of %s must be a dict", name)
+	}
+
+	queue := &Queue{Size: 100, Timeout: 10 * time.Second}
+	if size, ok := data["size"]; ok {
+		if size, ok := size.(int); ok && size > 0 {
+			queue.Size = size
+		} else {
+			return 0, nil, fmt.Errorf("queue size of %s must be a positive int", name)
+		}
+	}
+
+	if timeout, ok := data["timeout"]; ok {
+		if timeout, ok := loadDuration(timeout); ok && timeout > 0 {
+			queue.Timeout = timeout
+		} else {
+			return 0, nil, fmt.Errorf("queue timeout of %s must be a positive duration", name)
+		}
+	}
+	return maxConns, queue, nil
+}
+
+func loadServerMirror(serverData map[string]any, name string) (*Mirror, error) {
+	mirrorData, ok := serverData["mirror"]
+	if !ok {
+		return nil, nil
+	}
+
+	data, ok := mirrorData.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("mirror of %s must be a dict", name)
+	}
+
+	mirror := &Mirror{
+		Percent:     100,
+		MaxBodySize: 1 << 20,
+		Timeout:     5 * time.Second,
+	}
+	switch forward := data["forward"].(type) {
+	case string:
+		mirror.Forward = []*Forward{{Addr: forward, Weight: 1}}
+	case []any:
+		for _, addr := range forward {
+			addr, ok := addr.(string)
+			if !ok {
+				return nil, fmt.Errorf("mirror forward of %s must be a string array", name)
+			}
+			mirror.Forward = append(mirror.Forward, &Forward{Addr: addr, Weight: 1})
+		}
+	}
+	if len(mirror.Forward) == 0 {
+		return nil, fmt.Errorf("mirror of %s must have a forward", name)
+	}
+
+	if percent, ok := data["percent"]; ok {
+		var value float64
+		switch percent := percent.(type) {
+		case int:
+			value = float64(percent)
+		case float64:
+			value = percent
+		default:
+			value = -1
+		}
+		if value < 0 || value > 100 {
+			return nil, fmt.Errorf("mirror percent of %s must be between 0 and 100", name)
+		}
+		mirror.Percent = value
+	}
+
+	if maxBodySize, ok := data["max_body_size"]; ok {
+		if maxBodySize, ok := loadSize(maxBodySize); ok {
+			mirror.MaxBodySize = maxBodySize
+		} else {
+			return nil, fmt.Errorf("mirror max_body_size of %s must be a size", name)
+		}
+	}
+
+	if timeout, ok := data["timeout"]; ok {
+		if timeout, ok := loadDuration(timeout); ok && timeout > 0 {
+			mirror.Timeout = timeout
+		} else {
+			return nil, fmt.Errorf("mirror timeout of %s must be a positive duration", name)
+		}
+	}
+	return mirror, nil
+}
+
+// ParseForwards reads a list of forwards in JSON or YAML format, with the
+// same format as the forward field of the configuration file.
+func ParseForwards(data []byte) ([]*Forward, error) {
+	var list []any
+	if err := yaml.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, errors.New("the list of forwards is empty")
+	}
+
+	forwards, _, err := loadServerLoadBalancer(list, "discovery")
+	if err != nil {
+		return nil, err
+	}
+	for i, forward := range forwards {
+		if forward.Addr == "" {
+			return nil, fmt.Errorf("forward %d must have an addres", i)
+		}
+	}
+	return forwards, nil
+}
+
+// loadStatusCodes accepts a single status code or a list of them.
+func loadStatusCodes(value any) ([]int, bool) {
+	if code, ok := value.(int); ok {
+		value = []any{code}
+	}
+
+	list, ok := value.([]any)
+	if !ok {
+		return nil, false
+	}
+
+	codes := make([]int, len(list))
+	for i, v := range list {
+		code, ok := v.(int)
+		if !ok || code < 100 || code > 599 {
+			return nil, false
+		}
+		codes[i] = code
+	}
+	return codes, true
+}
+
+// loadDuration accepts an integer number of seconds or a string
+// in the format of time.ParseDuration (e.g. 1h30m).
+func loadDuration(value any) (time.Duration, bool) {
+	switch v := value.(type) {
+	case int:
+		if v < 0 {
+			return 0, false
+		}
+		return time.Duration(v) * time.Second, true
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return 0, false
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// parsePrefix accepts a network in CIDR notation or a single IP.
+func parsePrefix(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// loadSize accepts a number of bytes or a string with a unit (B, KB, MB
+// or GB, powers of 1024).
+func loadSize(value any) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), v >= 0
+	case string:
+		v = strings.ToUpper(strings.TrimSpace(v))
+		unit := int64(1)
+		for _, suffix := range []struct {
+			name string
+			size int64
+		}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"B", 1}} {
+			if strings.HasSuffix(v, suffix.name) {
+				v = strings.TrimSpace(strings.TrimSuffix(v, suffix.name))
+				unit = suffix.size
+				break
+			}
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return 0, false
+		}
+		return n * unit, true
+	}
+	return 0, false
+}
+
 func deserialize(filePath string) (map[string]any, error) {
 	fileData, err := os.ReadFile(filePath)
 	if err != nil {
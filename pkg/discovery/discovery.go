@@ -0,0 +1,14 @@
+package discovery
+
+import "github.com/MAD-py/grx/pkg/config"
+
+// Source finds the forwards of a server dynamically.
+type Source interface {
+	// Watch calls update each time the forwards change and fail when they
+	// can not be obtained, in which case the last forwards must be kept.
+	// It returns once stop is closed.
+	Watch(stop <-chan struct{}, update func([]*config.Forward), fail func(error))
+
+	// String describes the source in the logs.
+	String() string
+}
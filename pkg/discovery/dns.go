@@ -0,0 +1,371 @@
+package discovery
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MAD-py/grx/pkg/config"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// Timeout of each DNS query.
+	dnsTimeout = 5 * time.Second
+
+	// Minimum time between resolutions, even if the TTL is lower.
+	minResolveInterval = time.Second
+
+	maxUDPSize = 4096
+)
+
+// DNS resolves periodically a host (A/AAAA records) or a service (SRV
+// records), each address found is a forward. The resolution is repeated
+// when the TTL of the records expires or after the configured interval.
+type DNS struct {
+	// Forward used as template of the forwards found.
+	forward *config.Forward
+
+	// Address of the DNS server.
+	resolver string
+
+	interval time.Duration
+}
+
+func (d *DNS) Watch(
+	stop <-chan struct{}, update func([]*config.Forward), fail func(error),
+) {
+	var last []*config.Forward
+	for {
+		next := d.interval
+		forwards, ttl, err := d.resolve()
+		if err != nil {
+			fail(err)
+		} else {
+			if !equal(forwards, last) {
+				update(forwards)
+				last = forwards
+			}
+			if ttl < next {
+				next = ttl
+			}
+		}
+		if next < minResolveInterval {
+			next = minResolveInterval
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(next):
+		}
+	}
+}
+
+func (d *DNS) String() string {
+	if d.forward.SRV != "" {
+		return fmt.Sprintf("srv %s", d.forward.SRV)
+	}
+	return fmt.Sprintf("dns %s", d.forward.DNS)
+}
+
+// resolve returns the forwards found and the lowest TTL of the records.
+func (d *DNS) resolve() ([]*config.Forward, time.Duration, error) {
+	if d.forward.SRV != "" {
+		return d.resolveSRV()
+	}
+
+	host, port, err := net.SplitHostPort(d.forward.DNS)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ips, ttl, err := d.lookupIP(host, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	forwards := make([]*config.Forward, len(ips))
+	for i, ip := range ips {
+		forwards[i] = d.newForward(net.JoinHostPort(ip, port), d.forward.Weight, false)
+	}
+	return forwards, ttl, nil
+}
+
+// resolveSRV uses the priority of the records to decide which forwards are
+// backups (all but the lowest priority) and their weight as the weight.
+func (d *DNS) resolveSRV() ([]*config.Forward, time.Duration, error) {
+	msg, err := d.query(d.forward.SRV, dnsmessage.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ttl := time.Duration(-1)
+	var records []dnsmessage.SRVResource
+	for _, answer := range msg.Answers {
+		if srv, ok := answer.Body.(*dnsmessage.SRVResource); ok {
+			records = append(records, *srv)
+			ttl = minTTL(ttl, answer.Header.TTL)
+		}
+	}
+	if len(records) == 0 {
+		return nil, 0, fmt.Errorf("no SRV records found for %s", d.forward.SRV)
+	}
+
+	priority := records[0].Priority
+	for _, record := range records {
+		if record.Priority < priority {
+			priority = record.Priority
+		}
+	}
+
+	var forwards []*config.Forward
+	for _, record := range records {
+		target := record.Target.String()
+		ips, targetTTL, err := d.lookupIP(target, msg.Additionals)
+		if err != nil {
+			return nil, 0, err
+		}
+		if targetTTL < ttl {
+			ttl = targetTTL
+		}
+
+		weight := d.forward.Weight
+		if record.Weight > 0 {
+			weight = uint8(record.Weight)
+			if record.Weight > 255 {
+				weight = 255
+			}
+		}
+
+		port := strconv.Itoa(int(record.Port))
+		for _, ip := range ips {
+			forwards = append(forwards, d.newForward(
+				net.JoinHostPort(ip, port), weight, record.Priority != priority,
+			))
+		}
+	}
+	return forwards, ttl, nil
+}
+
+// lookupIP returns the A and AAAA records of the host, the additional
+// records of a previous response are used if they contain the host.
+func (d *DNS) lookupIP(
+	host string, additionals []dnsmessage.Resource,
+) ([]string, time.Duration, error) {
+	ips, ttl := ipRecords(host, additionals)
+	if len(ips) > 0 {
+		return ips, ttl, nil
+	}
+
+	// A host can have only one type of records, so the query of
+	// the other type is allowed to fail.
+	err := fmt.Errorf("no A or AAAA records found for %s", host)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		msg, queryErr := d.query(host, qtype)
+		if queryErr != nil {
+			err = queryErr
+			continue
+		}
+		found, foundTTL := ipRecords(host, msg.Answers)
+		if len(found) > 0 && (ttl < 0 || foundTTL < ttl) {
+			ttl = foundTTL
+		}
+		ips = append(ips, found...)
+	}
+
+	if len(ips) == 0 {
+		return nil, 0, err
+	}
+	return ips, ttl, nil
+}
+
+// query sends a question to the DNS server, the query is repeated
+// over TCP if the response is truncated.
+func (d *DNS) query(name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	qname, err := dnsmessage.NewName(fqdn(name))
+	if err != nil {
+		return nil, err
+	}
+
+	id := uint16(rand.Intn(1 << 16))
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  qname,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packet, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := d.exchange("udp", packet, id)
+	if err == nil && msg.Header.Truncated {
+		msg, err = d.exchange("tcp", packet, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch msg.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+		return msg, nil
+	case dnsmessage.RCodeNameError:
+		return nil, fmt.Errorf("%s does not exist", name)
+	}
+	return nil, fmt.Errorf("dns query of %s failed: %s", name, msg.Header.RCode)
+}
+
+func (d *DNS) exchange(network string, packet []byte, id uint16) (*dnsmessage.Message, error) {
+	conn, err := net.DialTimeout(network, d.resolver, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+
+	var response []byte
+	if network == "tcp" {
+		length := make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(len(packet)))
+		if _, err := conn.Write(append(length, packet...)); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		response = make([]byte, binary.BigEndian.Uint16(length))
+		if _, err := io.ReadFull(conn, response); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+		response = make([]byte, maxUDPSize)
+		n, err := conn.Read(response)
+		if err != nil {
+			return nil, err
+		}
+		response = response[:n]
+	}
+
+	msg := &dnsmessage.Message{}
+	if err := msg.Unpack(response); err != nil {
+		return nil, err
+	}
+	if msg.Header.ID != id || !msg.Header.Response {
+		return nil, errors.New("invalid dns response")
+	}
+	return msg, nil
+}
+
+func (d *DNS) newForward(addr string, weight uint8, backup bool) *config.Forward {
+	return &config.Forward{
+		Addr:      addr,
+		Weight:    weight,
+		Backup:    backup || d.forward.Backup,
+		SlowStart: d.forward.SlowStart,
+		MaxConns:  d.forward.MaxConns,
+	}
+}
+
+// NewDNS creates the source of a dns or srv forward.
+func NewDNS(forward *config.Forward, resolver *config.Resolver) *DNS {
+	addr := resolver.Addr
+	if addr == "" {
+		addr = systemResolver()
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+
+	return &DNS{
+		forward:  forward,
+		resolver: addr,
+		interval: resolver.Interval,
+	}
+}
+
+// systemResolver returns the first nameserver of /etc/resolv.conf.
+func systemResolver() string {
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "127.0.0.1:53"
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+func ipRecords(host string, resources []dnsmessage.Resource) ([]string, time.Duration) {
+	ttl := time.Duration(-1)
+	var ips []string
+	for _, resource := range resources {
+		if !strings.EqualFold(resource.Header.Name.String(), fqdn(host)) {
+			continue
+		}
+		switch body := resource.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]).String())
+		default:
+			continue
+		}
+		ttl = minTTL(ttl, resource.Header.TTL)
+	}
+	return ips, ttl
+}
+
+func minTTL(current time.Duration, ttl uint32) time.Duration {
+	d := time.Duration(ttl) * time.Second
+	if current < 0 || d < current {
+		return d
+	}
+	return current
+}
+
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// equal reports if two lists of forwards contain the same forwards.
+func equal(a, b []*config.Forward) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	forwards := make(map[config.Forward]int, len(a))
+	for _, forward := range a {
+		forwards[*forward]++
+	}
+	for _, forward := range b {
+		if forwards[*forward] == 0 {
+			return false
+		}
+		forwards[*forward]--
+	}
+	return true
+}
@@ -0,0 +1,457 @@
+package discovery
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MAD-py/grx/pkg/config"
+	"github.com/MAD-py/grx/pkg/lb"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsServer is a stand-in DNS server that answers over UDP and TCP on the
+// same port with the records it contains.
+type dnsServer struct {
+	t *testing.T
+
+	addr string
+
+	mu sync.Mutex
+
+	// Answers of each question, by type and name.
+	records map[dnsmessage.Type]map[string][]dnsmessage.Resource
+
+	// Responses over UDP are truncated without answers.
+	truncate bool
+
+	// Every query is answered with SERVFAIL.
+	fail bool
+
+	// Queries received over each network.
+	queries map[string]int
+}
+
+func (s *dnsServer) set(qtype dnsmessage.Type, name string, resources ...dnsmessage.Resource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[qtype][name] = resources
+}
+
+func (s *dnsServer) setTruncate(truncate bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.truncate = truncate
+}
+
+func (s *dnsServer) setFail(fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = fail
+}
+
+func (s *dnsServer) count(network string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries[network]
+}
+
+// answer builds the response to the query received over the network.
+func (s *dnsServer) answer(network string, packet []byte) []byte {
+	var query dnsmessage.Message
+	if err := query.Unpack(packet); err != nil || len(query.Questions) != 1 {
+		s.t.Errorf("invalid dns query: %v", err)
+		return nil
+	}
+	question := query.Questions[0]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries[network]++
+
+	response := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.Header.ID,
+			Response:           true,
+			Authoritative:      true,
+			RecursionAvailable: true,
+		},
+		Questions: query.Questions,
+	}
+	switch {
+	case s.fail:
+		response.Header.RCode = dnsmessage.RCodeServerFailure
+	case s.truncate && network == "udp":
+		response.Header.Truncated = true
+	default:
+		answers, ok := s.records[question.Type][question.Name.String()]
+		if !ok && len(s.records[dnsmessage.TypeA][question.Name.String()]) == 0 &&
+			len(s.records[dnsmessage.TypeAAAA][question.Name.String()]) == 0 &&
+			len(s.records[dnsmessage.TypeSRV][question.Name.String()]) == 0 {
+			response.Header.RCode = dnsmessage.RCodeNameError
+		}
+		response.Answers = answers
+	}
+
+	packed, err := response.Pack()
+	if err != nil {
+		s.t.Errorf("dns response could not be packed: %s", err)
+		return nil
+	}
+	return packed
+}
+
+func (s *dnsServer) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if response := s.answer("udp", buf[:n]); response != nil {
+			conn.WriteTo(response, addr)
+		}
+	}
+}
+
+func (s *dnsServer) serveTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			length := make([]byte, 2)
+			if _, err := io.ReadFull(conn, length); err != nil {
+				return
+			}
+			packet := make([]byte, binary.BigEndian.Uint16(length))
+			if _, err := io.ReadFull(conn, packet); err != nil {
+				return
+			}
+			response := s.answer("tcp", packet)
+			if response == nil {
+				return
+			}
+			binary.BigEndian.PutUint16(length, uint16(len(response)))
+			conn.Write(append(length, response...))
+		}()
+	}
+}
+
+func newDNSServer(t *testing.T) *dnsServer {
+	t.Helper()
+
+	// The TCP listener must use the port of the UDP one, which
+	// may be taken, so a few ports are tried.
+	var packetConn net.PacketConn
+	var listener net.Listener
+	for i := 0; i < 10 && listener == nil; i++ {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener, err = net.Listen("tcp", conn.LocalAddr().String())
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		packetConn = conn
+	}
+	if listener == nil {
+		t.Fatal("no port available for the dns server")
+	}
+
+	s := &dnsServer{
+		t:    t,
+		addr: packetConn.LocalAddr().String(),
+		records: map[dnsmessage.Type]map[string][]dnsmessage.Resource{
+			dnsmessage.TypeA:    {},
+			dnsmessage.TypeAAAA: {},
+			dnsmessage.TypeSRV:  {},
+		},
+		queries: make(map[string]int),
+	}
+	go s.serveUDP(packetConn)
+	go s.serveTCP(listener)
+	t.Cleanup(func() {
+		packetConn.Close()
+		listener.Close()
+	})
+	return s
+}
+
+func aRecord(name string, ip string, ttl uint32) dnsmessage.Resource {
+	var a [4]byte
+	copy(a[:], net.ParseIP(ip).To4())
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name: dnsmessage.MustNewName(name), Class: dnsmessage.ClassINET, TTL: ttl,
+		},
+		Body: &dnsmessage.AResource{A: a},
+	}
+}
+
+func aaaaRecord(name string, ip string, ttl uint32) dnsmessage.Resource {
+	var aaaa [16]byte
+	copy(aaaa[:], net.ParseIP(ip).To16())
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name: dnsmessage.MustNewName(name), Class: dnsmessage.ClassINET, TTL: ttl,
+		},
+		Body: &dnsmessage.AAAAResource{AAAA: aaaa},
+	}
+}
+
+func srvRecord(name, target string, priority, weight, port uint16, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name: dnsmessage.MustNewName(name), Class: dnsmessage.ClassINET, TTL: ttl,
+		},
+		Body: &dnsmessage.SRVResource{
+			Priority: priority,
+			Weight:   weight,
+			Port:     port,
+			Target:   dnsmessage.MustNewName(target),
+		},
+	}
+}
+
+func addrs(forwards []*config.Forward) []string {
+	list := make([]string, len(forwards))
+	for i, forward := range forwards {
+		list[i] = forward.Addr
+	}
+	sort.Strings(list)
+	return list
+}
+
+func equalAddrs(forwards []*config.Forward, want ...string) bool {
+	got := addrs(forwards)
+	sort.Strings(want)
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDNSResolveAAndAAAA(t *testing.T) {
+	server := newDNSServer(t)
+	server.set(dnsmessage.TypeA, "app.test.",
+		aRecord("app.test.", "10.0.0.1", 30),
+		aRecord("app.test.", "10.0.0.2", 20),
+	)
+	server.set(dnsmessage.TypeAAAA, "app.test.", aaaaRecord("app.test.", "fd00::1", 60))
+
+	source := NewDNS(
+		&config.Forward{DNS: "app.test:8080", Weight: 3},
+		&config.Resolver{Addr: server.addr, Interval: time.Minute},
+	)
+	forwards, ttl, err := source.resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalAddrs(forwards, "10.0.0.1:8080", "10.0.0.2:8080", "[fd00::1]:8080") {
+		t.Fatalf("forwards = %v", addrs(forwards))
+	}
+	for _, forward := range forwards {
+		if forward.Weight != 3 || forward.Backup {
+			t.Errorf("forward %s = %+v, want the weight of the template", forward.Addr, forward)
+		}
+	}
+	if ttl != 20*time.Second {
+		t.Errorf("ttl = %s, want 20s", ttl)
+	}
+}
+
+func TestDNSResolveSRV(t *testing.T) {
+	server := newDNSServer(t)
+	server.set(dnsmessage.TypeSRV, "_http._tcp.app.test.",
+		srvRecord("_http._tcp.app.test.", "a.app.test.", 10, 5, 8001, 60),
+		srvRecord("_http._tcp.app.test.", "b.app.test.", 10, 0, 8002, 60),
+		srvRecord("_http._tcp.app.test.", "c.app.test.", 20, 1000, 8003, 60),
+	)
+	server.set(dnsmessage.TypeA, "a.app.test.", aRecord("a.app.test.", "10.0.0.1", 15))
+	server.set(dnsmessage.TypeA, "b.app.test.", aRecord("b.app.test.", "10.0.0.2", 60))
+	server.set(dnsmessage.TypeAAAA, "c.app.test.", aaaaRecord("c.app.test.", "fd00::3", 60))
+
+	source := NewDNS(
+		&config.Forward{SRV: "_http._tcp.app.test", Weight: 2},
+		&config.Resolver{Addr: server.addr, Interval: time.Minute},
+	)
+	forwards, ttl, err := source.resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]config.Forward{
+		"10.0.0.1:8001":  {Weight: 5},
+		"10.0.0.2:8002":  {Weight: 2},
+		"[fd00::3]:8003": {Weight: 255, Backup: true},
+	}
+	if len(forwards) != len(want) {
+		t.Fatalf("forwards = %v", addrs(forwards))
+	}
+	for _, forward := range forwards {
+		w, ok := want[forward.Addr]
+		if !ok {
+			t.Fatalf("unexpected forward %s", forward.Addr)
+		}
+		if forward.Weight != w.Weight || forward.Backup != w.Backup {
+			t.Errorf(
+				"forward %s has weight %d and backup %t, want %d and %t",
+				forward.Addr, forward.Weight, forward.Backup, w.Weight, w.Backup,
+			)
+		}
+	}
+	if ttl != 15*time.Second {
+		t.Errorf("ttl = %s, want 15s", ttl)
+	}
+}
+
+// TestDNSMaxConns checks that the limit of simultaneous requests of the
+// template reaches the servers found.
+func TestDNSMaxConns(t *testing.T) {
+	server := newDNSServer(t)
+	server.set(dnsmessage.TypeA, "app.test.", aRecord("app.test.", "10.0.0.1", 30))
+	server.set(dnsmessage.TypeSRV, "_http._tcp.app.test.",
+		srvRecord("_http._tcp.app.test.", "app.test.", 10, 1, 8001, 60),
+	)
+
+	for _, forward := range []*config.Forward{
+		{DNS: "app.test:80", MaxConns: 2},
+		{SRV: "_http._tcp.app.test", MaxConns: 2},
+	} {
+		source := NewDNS(forward, &config.Resolver{Addr: server.addr, Interval: time.Minute})
+		forwards, _, err := source.resolve()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(forwards) != 1 {
+			t.Fatalf("%s found %v", source, addrs(forwards))
+		}
+		if forwards[0].MaxConns != 2 {
+			t.Fatalf("%s found a forward with max_conns %d, want 2", source, forwards[0].MaxConns)
+		}
+
+		backend := lb.NewBackend(forwards[0])
+		for i := 0; i < 2; i++ {
+			if !backend.Acquire() {
+				t.Fatalf("%s: request %d was refused below the limit", source, i+1)
+			}
+		}
+		if backend.Acquire() || !backend.Full() {
+			t.Errorf("%s: the server found accepts requests above the limit", source)
+		}
+	}
+}
+
+func TestDNSTruncatedResponseUsesTCP(t *testing.T) {
+	server := newDNSServer(t)
+	server.set(dnsmessage.TypeA, "app.test.", aRecord("app.test.", "10.0.0.1", 30))
+	server.setTruncate(true)
+
+	source := NewDNS(
+		&config.Forward{DNS: "app.test:80"},
+		&config.Resolver{Addr: server.addr, Interval: time.Minute},
+	)
+	forwards, _, err := source.resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalAddrs(forwards, "10.0.0.1:80") {
+		t.Fatalf("forwards = %v", addrs(forwards))
+	}
+	if server.count("udp") == 0 || server.count("tcp") == 0 {
+		t.Errorf(
+			"%d udp and %d tcp queries, want the udp query repeated over tcp",
+			server.count("udp"), server.count("tcp"),
+		)
+	}
+}
+
+// TestDNSWatch checks that the records are resolved again when their TTL
+// expires and that the last forwards are kept while the resolver fails.
+func TestDNSWatch(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the ttl of the records")
+	}
+
+	server := newDNSServer(t)
+	server.set(dnsmessage.TypeA, "app.test.", aRecord("app.test.", "10.0.0.1", 1))
+
+	updates := make(chan []*config.Forward, 10)
+	failures := make(chan error, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	source := NewDNS(
+		&config.Forward{DNS: "app.test:80"},
+		&config.Resolver{Addr: server.addr, Interval: time.Hour},
+	)
+	go source.Watch(
+		stop,
+		func(forwards []*config.Forward) { updates <- forwards },
+		func(err error) { failures <- err },
+	)
+
+	wait := func() []*config.Forward {
+		t.Helper()
+		select {
+		case forwards := <-updates:
+			return forwards
+		case err := <-failures:
+			t.Fatalf("resolution failed: %s", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the records were not resolved again after their ttl")
+		}
+		return nil
+	}
+
+	if forwards := wait(); !equalAddrs(forwards, "10.0.0.1:80") {
+		t.Fatalf("forwards = %v", addrs(forwards))
+	}
+
+	// The interval is an hour, only the ttl of one second makes the
+	// source notice the change.
+	server.set(dnsmessage.TypeA, "app.test.",
+		aRecord("app.test.", "10.0.0.1", 1),
+		aRecord("app.test.", "10.0.0.2", 1),
+	)
+	if forwards := wait(); !equalAddrs(forwards, "10.0.0.1:80", "10.0.0.2:80") {
+		t.Fatalf("forwards = %v", addrs(forwards))
+	}
+
+	server.setFail(true)
+	select {
+	case <-failures:
+	case forwards := <-updates:
+		t.Fatalf("forwards updated to %v while the resolver fails", addrs(forwards))
+	case <-time.After(5 * time.Second):
+		t.Fatal("the failure of the resolver was not reported")
+	}
+	select {
+	case forwards := <-updates:
+		t.Fatalf("forwards updated to %v while the resolver fails", addrs(forwards))
+	default:
+	}
+
+	// Once the resolver recovers, the same forwards are not sent again.
+	server.setFail(false)
+	time.Sleep(2500 * time.Millisecond)
+	select {
+	case forwards := <-updates:
+		t.Fatalf("forwards updated to %v although they did not change", addrs(forwards))
+	default:
+	}
+}
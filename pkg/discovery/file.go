@@ -0,0 +1,71 @@
+package discovery
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/MAD-py/grx/pkg/config"
+)
+
+// File reads the forwards from a JSON or YAML file, the file is watched
+// for changes and checked periodically in case the changes can not be
+// watched. If the new content is not valid the last forwards are kept.
+type File struct {
+	path string
+
+	interval time.Duration
+}
+
+func (f *File) Watch(
+	stop <-chan struct{}, update func([]*config.Forward), fail func(error),
+) {
+	events := watchFile(f.path, stop)
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	var last []*config.Forward
+	var lastModTime time.Time
+	var lastSize int64 = -1
+	for {
+		info, err := os.Stat(f.path)
+		if err != nil {
+			if lastSize != -1 {
+				fail(err)
+				lastSize = -1
+			}
+		} else if info.ModTime() != lastModTime || info.Size() != lastSize {
+			lastModTime = info.ModTime()
+			lastSize = info.Size()
+
+			forwards, err := f.read()
+			if err != nil {
+				fail(err)
+			} else if !equal(forwards, last) {
+				update(forwards)
+				last = forwards
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-events:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (f *File) String() string { return fmt.Sprintf("file %s", f.path) }
+
+func (f *File) read() ([]*config.Forward, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	return config.ParseForwards(data)
+}
+
+func NewFile(discovery *config.Discovery) *File {
+	return &File{path: discovery.File, interval: discovery.Interval}
+}
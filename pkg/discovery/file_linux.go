@@ -0,0 +1,49 @@
+//go:build linux
+
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// watchFile notifies the changes in the directory of the file using
+// inotify, the directory is watched instead of the file so that the
+// file can be replaced atomically. It returns nil if the changes can
+// not be watched.
+func watchFile(path string, stop <-chan struct{}) <-chan struct{} {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil
+	}
+
+	mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO |
+		syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY)
+	if _, err := syscall.InotifyAddWatch(fd, filepath.Dir(path), mask); err != nil {
+		syscall.Close(fd)
+		return nil
+	}
+
+	// The file descriptor is non-blocking so the runtime poller is used
+	// and closing the file unblocks the read.
+	file := os.NewFile(uintptr(fd), "inotify")
+	events := make(chan struct{}, 1)
+	go func() {
+		<-stop
+		file.Close()
+	}()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := file.Read(buf); err != nil {
+				return
+			}
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return events
+}
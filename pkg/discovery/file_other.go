@@ -0,0 +1,6 @@
+//go:build !linux
+
+package discovery
+
+// watchFile is not supported, the file is only checked periodically.
+func watchFile(path string, stop <-chan struct{}) <-chan struct{} { return nil }
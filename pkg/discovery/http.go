@@ -0,0 +1,251 @@
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MAD-py/grx/pkg/config"
+)
+
+const (
+	// Maximum size of the response of the registry.
+	maxRegistryResponse = 16 << 20 // INFO: 16 MB
+
+	// Timeout of the requests to the registry, the long polls
+	// can take up to the interval more.
+	registryTimeout = 10 * time.Second
+
+	// Minimum time between long polls, in case the registry
+	// responds immediately.
+	minLongPollInterval = time.Second
+)
+
+// HTTP polls a registry that returns the list of forwards in JSON format.
+// The ETag of the responses is used to avoid processing the same list
+// again and, with long polling, the Consul blocking queries are used so
+// that the registry responds as soon as the list changes. If the registry
+// is down or returns an invalid list the last forwards are kept.
+type HTTP struct {
+	url string
+
+	mapping *config.DiscoveryMapping
+
+	longPoll bool
+
+	interval time.Duration
+
+	client *http.Client
+
+	// ETag of the last response.
+	etag string
+
+	// Index of the last response of a blocking query.
+	index string
+}
+
+func (h *HTTP) Watch(
+	stop <-chan struct{}, update func([]*config.Forward), fail func(error),
+) {
+	var last []*config.Forward
+	for {
+		start := time.Now()
+		forwards, err := h.poll()
+		if err != nil {
+			fail(err)
+		} else if forwards != nil && !equal(forwards, last) {
+			update(forwards)
+			last = forwards
+		}
+
+		next := h.interval
+		if h.longPoll && err == nil && h.index != "" {
+			next = minLongPollInterval - time.Since(start)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(next):
+		}
+	}
+}
+
+func (h *HTTP) String() string { return fmt.Sprintf("registry %s", h.url) }
+
+// poll requests the list of forwards, it returns nil if it has not changed.
+func (h *HTTP) poll() ([]*config.Forward, error) {
+	req, err := http.NewRequest(http.MethodGet, h.pollURL(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if h.etag != "" {
+		req.Header.Set("If-None-Match", h.etag)
+	}
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("registry responded with status %d", res.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxRegistryResponse))
+	if err != nil {
+		return nil, err
+	}
+
+	var forwards []*config.Forward
+	if h.mapping == nil {
+		forwards, err = config.ParseForwards(body)
+	} else {
+		forwards, err = h.parse(body)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	h.etag = res.Header.Get("ETag")
+	if h.longPoll {
+		h.index = res.Header.Get("X-Consul-Index")
+	}
+	return forwards, nil
+}
+
+// pollURL adds the parameters of the blocking query to the url.
+func (h *HTTP) pollURL() string {
+	if h.index == "" {
+		return h.url
+	}
+
+	u, err := url.Parse(h.url)
+	if err != nil {
+		return h.url
+	}
+	query := u.Query()
+	query.Set("index", h.index)
+	// The wait is sent in seconds, a wait of 0s would make the registry
+	// respond immediately.
+	wait := h.interval
+	if wait < time.Second {
+		wait = time.Second
+	}
+	query.Set("wait", fmt.Sprintf("%ds", int(wait.Seconds())))
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// parse extracts the forwards from the response using the mapping.
+func (h *HTTP) parse(body []byte) ([]*config.Forward, error) {
+	var data any
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, err
+	}
+
+	list, ok := lookup(data, h.mapping.List).([]any)
+	if !ok {
+		return nil, errors.New("the response does not contain a list of forwards")
+	}
+	if len(list) == 0 {
+		return nil, errors.New("the list of forwards is empty")
+	}
+
+	forwards := make([]*config.Forward, 0, len(list))
+	for i, item := range list {
+		if h.mapping.Checks != "" && !passing(lookup(item, h.mapping.Checks)) {
+			continue
+		}
+
+		var addr string
+		for _, path := range h.mapping.Address {
+			if v, ok := lookup(item, path).(string); ok && v != "" {
+				addr = v
+				break
+			}
+		}
+		if addr == "" {
+			return nil, fmt.Errorf("forward %d does not have an address", i)
+		}
+
+		if h.mapping.Port != "" {
+			port, ok := lookup(item, h.mapping.Port).(float64)
+			if !ok || port <= 0 || port > 65535 {
+				return nil, fmt.Errorf("forward %d does not have a valid port", i)
+			}
+			addr = net.JoinHostPort(addr, strconv.Itoa(int(port)))
+		}
+
+		weight := 1.0
+		if h.mapping.Weight != "" {
+			if w, ok := lookup(item, h.mapping.Weight).(float64); ok && w >= 1 {
+				weight = w
+			}
+		}
+		if weight > 255 {
+			weight = 255
+		}
+
+		forwards = append(forwards, &config.Forward{Addr: addr, Weight: uint8(weight)})
+	}
+	if len(forwards) == 0 {
+		return nil, errors.New("none of the forwards is passing its health checks")
+	}
+	return forwards, nil
+}
+
+// passing reports if all the health checks have the passing status.
+func passing(checks any) bool {
+	list, ok := checks.([]any)
+	if !ok {
+		return checks == nil
+	}
+	for _, check := range list {
+		if status, _ := lookup(check, "Status").(string); status != "passing" {
+			return false
+		}
+	}
+	return true
+}
+
+// lookup returns the value of the path (fields separated by dots).
+func lookup(data any, path string) any {
+	if path == "" {
+		return data
+	}
+	for _, field := range strings.Split(path, ".") {
+		object, ok := data.(map[string]any)
+		if !ok {
+			return nil
+		}
+		data = object[field]
+	}
+	return data
+}
+
+func NewHTTP(discovery *config.Discovery) *HTTP {
+	timeout := registryTimeout
+	if discovery.LongPoll {
+		timeout += discovery.Interval
+	}
+	return &HTTP{
+		url:      discovery.URL,
+		mapping:  discovery.Mapping,
+		longPoll: discovery.LongPoll,
+		interval: discovery.Interval,
+		client:   &http.Client{Timeout: timeout},
+	}
+}
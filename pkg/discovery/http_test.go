@@ -0,0 +1,250 @@
+package discovery
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MAD-py/grx/pkg/config"
+)
+
+// registry is a stub registry that answers each request with the next
+// handler, the last one is repeated.
+type registry struct {
+	mu sync.Mutex
+
+	handlers []http.HandlerFunc
+
+	// Requests received.
+	requests []*http.Request
+}
+
+func (r *registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	handler := r.handlers[0]
+	if len(r.handlers) > 1 {
+		r.handlers = r.handlers[1:]
+	}
+	r.requests = append(r.requests, req)
+	r.mu.Unlock()
+
+	handler(w, req)
+}
+
+func (r *registry) request(i int) *http.Request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.requests[i]
+}
+
+func newRegistry(t *testing.T, handlers ...http.HandlerFunc) (*registry, string) {
+	r := &registry{handlers: handlers}
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return r, server.URL
+}
+
+func respond(status int, body string, headers ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		for i := 0; i+1 < len(headers); i += 2 {
+			w.Header().Set(headers[i], headers[i+1])
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}
+}
+
+const registryList = `[{"addres": "10.0.0.1:8080", "weight": 2}, {"addres": "10.0.0.2:8080"}]`
+
+func TestHTTPNotModified(t *testing.T) {
+	registry, url := newRegistry(t,
+		respond(http.StatusOK, registryList, "ETag", `"v1"`),
+		func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("If-None-Match") != `"v1"` {
+				respond(http.StatusOK, `[{"addres": "10.0.0.3:8080"}]`)(w, req)
+				return
+			}
+			w.WriteHeader(http.StatusNotModified)
+		},
+	)
+	source := NewHTTP(&config.Discovery{URL: url, Interval: time.Minute})
+
+	forwards, err := source.poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalAddrs(forwards, "10.0.0.1:8080", "10.0.0.2:8080") {
+		t.Fatalf("forwards = %v", addrs(forwards))
+	}
+
+	forwards, err = source.poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forwards != nil {
+		t.Fatalf("forwards = %v, want nil for a 304", addrs(forwards))
+	}
+	if got := registry.request(1).Header.Get("If-None-Match"); got != `"v1"` {
+		t.Errorf("If-None-Match = %q, want the ETag of the first response", got)
+	}
+}
+
+func TestHTTPConsulHealth(t *testing.T) {
+	_, url := newRegistry(t, respond(http.StatusOK, `[
+		{
+			"Node": {"Address": "10.0.0.1"},
+			"Service": {"Address": "10.0.1.1", "Port": 8080, "Weights": {"Passing": 3}},
+			"Checks": [{"Status": "passing"}, {"Status": "passing"}]
+		},
+		{
+			"Node": {"Address": "10.0.0.2"},
+			"Service": {"Address": "", "Port": 8081, "Weights": {"Passing": 1}},
+			"Checks": [{"Status": "passing"}]
+		},
+		{
+			"Node": {"Address": "10.0.0.3"},
+			"Service": {"Address": "10.0.1.3", "Port": 8082},
+			"Checks": [{"Status": "passing"}, {"Status": "critical"}]
+		}
+	]`))
+
+	file := filepath.Join(t.TempDir(), "grx.yml")
+	data := fmt.Sprintf(`
+servers:
+  - name: api
+    listen: 127.0.0.1:9000
+    discovery:
+      url: %s
+      format: consul_health
+`, url)
+	if err := os.WriteFile(file, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	servers, err := config.Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, ok := servers[0].(*config.ForwardServer)
+	if !ok {
+		t.Fatalf("server is %T, want a forward server", servers[0])
+	}
+
+	forwards, err := NewHTTP(server.Discovery).poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The service address is preferred to the node one and the instances
+	// with a failing check are skipped.
+	want := map[string]uint8{"10.0.1.1:8080": 3, "10.0.0.2:8081": 1}
+	if len(forwards) != len(want) {
+		t.Fatalf("forwards = %v", addrs(forwards))
+	}
+	for _, forward := range forwards {
+		weight, ok := want[forward.Addr]
+		if !ok {
+			t.Fatalf("unexpected forward %s", forward.Addr)
+		}
+		if forward.Weight != weight {
+			t.Errorf("weight of %s = %d, want %d", forward.Addr, forward.Weight, weight)
+		}
+	}
+}
+
+func TestHTTPLongPoll(t *testing.T) {
+	for _, test := range []struct {
+		interval time.Duration
+		wait     string
+	}{
+		{30 * time.Second, "30s"},
+		// A wait of 0s would make the registry respond immediately.
+		{100 * time.Millisecond, "1s"},
+	} {
+		registry, url := newRegistry(t,
+			respond(http.StatusOK, registryList, "X-Consul-Index", "42"),
+		)
+		source := NewHTTP(&config.Discovery{
+			URL: url + "/v1/health/service/api?passing=1", LongPoll: true, Interval: test.interval,
+		})
+
+		for i := 0; i < 2; i++ {
+			if _, err := source.poll(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		first, second := registry.request(0).URL.Query(), registry.request(1).URL.Query()
+		if first.Has("index") || first.Has("wait") {
+			t.Errorf("first poll %s is a blocking query", registry.request(0).URL)
+		}
+		if second.Get("index") != "42" || second.Get("wait") != test.wait {
+			t.Errorf(
+				"second poll has index %q and wait %q, want 42 and %s",
+				second.Get("index"), second.Get("wait"), test.wait,
+			)
+		}
+		if second.Get("passing") != "1" {
+			t.Errorf("second poll %s lost the query of the url", registry.request(1).URL)
+		}
+	}
+}
+
+// TestHTTPKeepsLastForwards checks that the last forwards are kept when
+// the registry fails or responds with an invalid list.
+func TestHTTPKeepsLastForwards(t *testing.T) {
+	_, url := newRegistry(t,
+		respond(http.StatusOK, registryList),
+		respond(http.StatusInternalServerError, `{"error": "down"}`),
+		respond(http.StatusOK, `[{"addres": "10.0.0.1:8080"`),
+		respond(http.StatusOK, `[]`),
+		respond(http.StatusOK, registryList),
+	)
+	source := NewHTTP(&config.Discovery{URL: url, Interval: 10 * time.Millisecond})
+
+	updates := make(chan []*config.Forward, 10)
+	failures := make(chan error, 10)
+	stop := make(chan struct{})
+	go source.Watch(
+		stop,
+		func(forwards []*config.Forward) { updates <- forwards },
+		func(err error) { failures <- err },
+	)
+
+	select {
+	case forwards := <-updates:
+		if !equalAddrs(forwards, "10.0.0.1:8080", "10.0.0.2:8080") {
+			t.Fatalf("forwards = %v", addrs(forwards))
+		}
+	case err := <-failures:
+		t.Fatalf("first poll failed: %s", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the registry was not polled")
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-failures:
+		case forwards := <-updates:
+			t.Fatalf("forwards updated to %v by an invalid response", addrs(forwards))
+		case <-time.After(5 * time.Second):
+			t.Fatal("the invalid response was not reported")
+		}
+	}
+
+	// The registry recovers with the same list, which is not sent again.
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+	select {
+	case forwards := <-updates:
+		t.Fatalf("forwards updated to %v although they did not change", addrs(forwards))
+	case err := <-failures:
+		t.Fatalf("poll failed after the registry recovered: %s", err)
+	default:
+	}
+}
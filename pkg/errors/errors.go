@@ -5,6 +5,9 @@ import "net/http"
 type ProxyError struct {
 	text       string
 	statusCode int
+
+	// Additional headers of the response (e.g. Retry-After).
+	header http.Header
 }
 
 func (e ProxyError) Error() string {
@@ -15,6 +18,32 @@ func (e ProxyError) StatusCode() int {
 	return e.statusCode
 }
 
+func (e ProxyError) Header() http.Header {
+	return e.header
+}
+
+// WithHeader adds a header to the response generated from the error.
+func (e *ProxyError) WithHeader(key, value string) *ProxyError {
+	if e.header == nil {
+		e.header = http.Header{}
+	}
+	e.header.Add(key, value)
+	return e
+}
+
+// ┏━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━┓ //
+// ┃               Redirection               ┃ //
+// ┗━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━┛ //
+
+// Found redirects the client to the location, it is not an error but it
+// is generated by the proxy instead of the server.
+func Found(location string) *ProxyError {
+	return (&ProxyError{
+		text:       "HTTP 302 FOUND",
+		statusCode: http.StatusFound,
+	}).WithHeader("Location", location)
+}
+
 // ┏━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━┓ //
 // ┃               Client error              ┃ //
 // ┗━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━┛ //
@@ -26,6 +55,20 @@ func BadRequest() *ProxyError {
 	}
 }
 
+func Unauthorized() *ProxyError {
+	return &ProxyError{
+		text:       "HTTP 401 UNAUTHORIZED",
+		statusCode: http.StatusUnauthorized,
+	}
+}
+
+func Forbidden() *ProxyError {
+	return &ProxyError{
+		text:       "HTTP 403 FORBIDDEN",
+		statusCode: http.StatusForbidden,
+	}
+}
+
 func NotFound() *ProxyError {
 	return &ProxyError{
 		text:       "HTTP 404 NOT FOUND",
@@ -33,6 +76,13 @@ func NotFound() *ProxyError {
 	}
 }
 
+func MethodNotAllowed() *ProxyError {
+	return &ProxyError{
+		text:       "HTTP 405 METHOD NOT ALLOWED",
+		statusCode: http.StatusMethodNotAllowed,
+	}
+}
+
 func RequestTimeout() *ProxyError {
 	return &ProxyError{
 		text:       "HTTP 408 REQUEST TIMEOUT",
@@ -40,13 +90,62 @@ func RequestTimeout() *ProxyError {
 	}
 }
 
+func ContentTooLarge() *ProxyError {
+	return &ProxyError{
+		text:       "HTTP 413 CONTENT TOO LARGE",
+		statusCode: http.StatusRequestEntityTooLarge,
+	}
+}
+
+func URITooLong() *ProxyError {
+	return &ProxyError{
+		text:       "HTTP 414 URI TOO LONG",
+		statusCode: http.StatusRequestURITooLong,
+	}
+}
+
+func TooManyRequests() *ProxyError {
+	return &ProxyError{
+		text:       "HTTP 429 TOO MANY REQUESTS",
+		statusCode: http.StatusTooManyRequests,
+	}
+}
+
+func RequestHeaderFieldsTooLarge() *ProxyError {
+	return &ProxyError{
+		text:       "HTTP 431 REQUEST HEADER FIELDS TOO LARGE",
+		statusCode: http.StatusRequestHeaderFieldsTooLarge,
+	}
+}
+
 // ┏━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━┓ //
 // ┃               Server error              ┃ //
 // ┗━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━┛ //
 
+func InternalServerError() *ProxyError {
+	return &ProxyError{
+		text:       "HTTP 500 INTERNAL SERVER ERROR",
+		statusCode: http.StatusInternalServerError,
+	}
+}
+
 func BadGateway() *ProxyError {
 	return &ProxyError{
 		text:       "HTTP 502 BAD GATEWAY",
 		statusCode: http.StatusBadGateway,
 	}
 }
+
+func ServiceUnavailable() *ProxyError {
+	return &ProxyError{
+		text:       "HTTP 503 SERVICE UNAVAILABLE",
+		statusCode: http.StatusServiceUnavailable,
+	}
+}
+
+func GatewayTimeout() *ProxyError {
+	return &ProxyError{
+		text:       "HTTP 504 GATEWAY TIMEOUT",
+		statusCode: http.StatusGatewayTimeout,
+	}
+}
@@ -0,0 +1,95 @@
+package grx
+
+import (
+	"net/netip"
+
+	"github.com/MAD-py/grx/pkg/config"
+)
+
+// accessList decides which clients are allowed by the first rule that
+// contains their IP, the networks of all the rules are kept in a prefix
+// trie per family so that the lookup does not depend on their number.
+type accessList struct {
+	rules []*config.AccessRule
+
+	ipv4 *prefixTrie
+	ipv6 *prefixTrie
+}
+
+// allowed reports if the client is allowed, the clients that do not
+// match any rule are allowed.
+func (a *accessList) allowed(addr netip.Addr) bool {
+	trie := a.ipv6
+	if addr.Is4() {
+		trie = a.ipv4
+	}
+
+	rule := trie.lookup(addr)
+	return rule < 0 || a.rules[rule].Allow
+}
+
+// prefixTrie is a binary trie of networks, each node that ends a network
+// keeps the first rule of that network.
+type prefixTrie struct {
+	root trieNode
+}
+
+type trieNode struct {
+	children [2]*trieNode
+
+	// Index of the first rule of the network ending at the node, -1 if no
+	// network ends at it.
+	rule int
+}
+
+func (t *prefixTrie) insert(prefix netip.Prefix, rule int) {
+	addr := prefix.Addr().AsSlice()
+	node := &t.root
+	for i := 0; i < prefix.Bits(); i++ {
+		bit := addr[i/8] >> (7 - i%8) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{rule: -1}
+		}
+		node = node.children[bit]
+	}
+	if node.rule < 0 || rule < node.rule {
+		node.rule = rule
+	}
+}
+
+// lookup returns the first rule of the networks that contain the IP, -1
+// if none of them does.
+func (t *prefixTrie) lookup(addr netip.Addr) int {
+	bytes := addr.AsSlice()
+	node := &t.root
+	rule := node.rule
+	for i := 0; i < len(bytes)*8; i++ {
+		node = node.children[bytes[i/8]>>(7-i%8)&1]
+		if node == nil {
+			break
+		}
+		if node.rule >= 0 && (rule < 0 || node.rule < rule) {
+			rule = node.rule
+		}
+	}
+	return rule
+}
+
+func newAccessList(config *config.Access) *accessList {
+	list := &accessList{
+		rules: config.Rules,
+		ipv4:  &prefixTrie{root: trieNode{rule: -1}},
+		ipv6:  &prefixTrie{root: trieNode{rule: -1}},
+	}
+
+	for i, rule := range config.Rules {
+		for _, prefix := range rule.Prefixes {
+			if prefix.Addr().Is4() {
+				list.ipv4.insert(prefix, i)
+			} else {
+				list.ipv6.insert(prefix, i)
+			}
+		}
+	}
+	return list
+}
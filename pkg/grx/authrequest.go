@@ -0,0 +1,215 @@
+package grx
+
+import (
+	"crypto/sha256"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MAD-py/grx/pkg/config"
+	"github.com/MAD-py/grx/pkg/errors"
+
+	proxyHTTP "github.com/MAD-py/grx/pkg/http"
+)
+
+const (
+	// maxAuthDecisions is the number of cached decisions after which the
+	// new ones are not cached until the expired ones are removed.
+	maxAuthDecisions = 10000
+
+	// maxAuthResponseSize limits the body of the allowed responses of the
+	// service that is read to reuse its connection.
+	maxAuthResponseSize = 64 << 10 // INFO: 64 KB
+)
+
+// authRequest authorizes the requests with a subrequest to an external
+// service, caching the allowed requests for a while.
+type authRequest struct {
+	name string
+
+	config *config.AuthRequest
+
+	client *http.Client
+
+	mu sync.Mutex
+
+	// Headers copied from the service by request key.
+	decisions map[[sha256.Size]byte]*authDecision
+}
+
+// authDecision is an allowed request and the headers copied from the
+// response of the service.
+type authDecision struct {
+	header  http.Header
+	expires time.Time
+}
+
+// authorize sends the subrequest for the request and copies the headers
+// of the service into it if it is allowed, otherwise it returns the
+// response for the client.
+func (a *authRequest) authorize(req *http.Request, conn net.Conn) *proxyHTTP.ProxyResponse {
+	// The response headers can only come from the service.
+	for _, header := range a.config.ResponseHeaders {
+		req.Header.Del(header)
+	}
+
+	subrequestHeader := a.header(req, conn)
+	key := authKey(subrequestHeader)
+	if header, ok := a.cached(key); ok {
+		addHeader(req.Header, header)
+		return nil
+	}
+
+	subrequest, err := http.NewRequest(http.MethodGet, a.config.URL, nil)
+	if err != nil {
+		log.Printf("%s => Auth request could not be created: %s", a.name, err)
+		return proxyHTTP.ErrorToResponse(req, errors.InternalServerError())
+	}
+	subrequest.Header = subrequestHeader
+
+	res, err := a.client.Do(subrequest)
+	if err != nil {
+		log.Printf("%s => Auth request failed: %s", a.name, err)
+		return proxyHTTP.ErrorToResponse(req, errors.InternalServerError())
+	}
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		header := http.Header{}
+		for _, name := range a.config.ResponseHeaders {
+			if values := res.Header.Values(name); len(values) > 0 {
+				header[name] = values
+			}
+		}
+		io.Copy(io.Discard, io.LimitReader(res.Body, maxAuthResponseSize))
+		res.Body.Close()
+
+		a.store(key, header)
+		addHeader(req.Header, header)
+		return nil
+	case res.StatusCode == http.StatusUnauthorized && a.config.LoginURL != "":
+		res.Body.Close()
+		return proxyHTTP.ErrorToResponse(req, errors.Found(a.loginURL(req)))
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden ||
+		(res.StatusCode >= 300 && res.StatusCode < 400):
+		res.Proto, res.ProtoMajor, res.ProtoMinor = req.Proto, req.ProtoMajor, req.ProtoMinor
+		return proxyHTTP.NewProxyResponse(res)
+	default:
+		res.Body.Close()
+		log.Printf("%s => Auth request responded with %s", a.name, res.Status)
+		return proxyHTTP.ErrorToResponse(req, errors.InternalServerError())
+	}
+}
+
+// header returns the headers of the subrequest, the configured headers of
+// the request and the original method, URI, client and host.
+func (a *authRequest) header(req *http.Request, conn net.Conn) http.Header {
+	header := http.Header{}
+	for _, name := range a.config.Headers {
+		if values := req.Header.Values(name); len(values) > 0 {
+			header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	header.Set("X-Original-Method", req.Method)
+	header.Set("X-Original-URI", req.RequestURI)
+	header.Set("X-Forwarded-For", remoteIP(conn).String())
+	header.Set("X-Forwarded-Host", req.Host)
+	return header
+}
+
+// authKey identifies the subrequest by all its headers, which are the
+// ones the decision can depend on.
+func authKey(header http.Header) [sha256.Size]byte {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hash := sha256.New()
+	for _, name := range names {
+		for _, value := range header[name] {
+			io.WriteString(hash, name+":"+value+"\x00")
+		}
+	}
+
+	var key [sha256.Size]byte
+	hash.Sum(key[:0])
+	return key
+}
+
+func (a *authRequest) cached(key [sha256.Size]byte) (http.Header, bool) {
+	if a.config.CacheTTL == 0 {
+		return nil, false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	decision, ok := a.decisions[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(decision.expires) {
+		delete(a.decisions, key)
+		return nil, false
+	}
+	return decision.header, true
+}
+
+func (a *authRequest) store(key [sha256.Size]byte, header http.Header) {
+	if a.config.CacheTTL == 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	if len(a.decisions) >= maxAuthDecisions {
+		for key, decision := range a.decisions {
+			if now.After(decision.expires) {
+				delete(a.decisions, key)
+			}
+		}
+		if len(a.decisions) >= maxAuthDecisions {
+			return
+		}
+	}
+	a.decisions[key] = &authDecision{header: header, expires: now.Add(a.config.CacheTTL)}
+}
+
+// loginURL returns the login page with the original URL of the request
+// in the rd parameter, so that the client can come back to it.
+func (a *authRequest) loginURL(req *http.Request) string {
+	scheme := req.Header.Get("X-Forwarded-Proto")
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	login, _ := url.Parse(a.config.LoginURL)
+	query := login.Query()
+	query.Set("rd", scheme+"://"+req.Host+req.RequestURI)
+	login.RawQuery = query.Encode()
+	return login.String()
+}
+
+func newAuthRequest(name string, config *config.AuthRequest) *authRequest {
+	return &authRequest{
+		name:   name,
+		config: config,
+		client: &http.Client{
+			Timeout: config.Timeout,
+			// The redirects of the service are sent to the client.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		decisions: make(map[[sha256.Size]byte]*authDecision),
+	}
+}
@@ -0,0 +1,355 @@
+package grx
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/MAD-py/grx/pkg/config"
+	"github.com/MAD-py/grx/pkg/errors"
+)
+
+const (
+	// htpasswdCheckInterval is the minimum time between the checks for
+	// changes of the htpasswd file.
+	htpasswdCheckInterval = time.Second
+
+	// maxAuthClients is the maximum number of clients whose failures are
+	// remembered, the least recently failed ones are forgotten.
+	maxAuthClients = 10000
+
+	// dummyHash is verified when the user does not exist, so that the time
+	// of the response does not reveal which users exist.
+	dummyHash = "$2a$10$u1H6oa1kCsFKooDSNJxDAOY89Dc3Pi9EyiTnNYk.R.mJ0xVYKVEUO"
+)
+
+// basicAuth authenticates the requests with the users of a htpasswd file,
+// the file is read again when it changes and the clients with too many
+// failed attempts are locked out for a while.
+type basicAuth struct {
+	name string
+
+	config *config.BasicAuth
+
+	// Value of the WWW-Authenticate header sent to the clients.
+	challenge string
+
+	mu sync.Mutex
+
+	// Password hashes by user.
+	users map[string]string
+
+	// Last check and state of the file, used to detect its changes.
+	checked time.Time
+	modTime time.Time
+	size    int64
+
+	// Failures of each client, the elements of the LRU list.
+	failures map[netip.Addr]*list.Element
+
+	// Failures from the most to the least recently failed client.
+	lru *list.List
+}
+
+// authFailures are the failed attempts of a client since the first one.
+type authFailures struct {
+	addr netip.Addr
+
+	count int
+	first time.Time
+}
+
+// authenticate checks the credentials of the request, removing them from
+// the request if the server is configured to do so.
+func (a *basicAuth) authenticate(req *http.Request, conn net.Conn) *errors.ProxyError {
+	addr := remoteIP(conn)
+	if retry, locked := a.locked(addr); locked {
+		return errors.TooManyRequests().WithHeader("Retry-After", seconds(retry))
+	}
+
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return errors.Unauthorized().WithHeader("WWW-Authenticate", a.challenge)
+	}
+
+	hash, found := a.lookup(user)
+	if !found {
+		verifyPassword(dummyHash, password)
+	}
+	if !found || !verifyPassword(hash, password) {
+		log.Printf("%s => Authentication failed for user %q [%s]", a.name, user, addr)
+		a.fail(addr)
+		return errors.Unauthorized().WithHeader("WWW-Authenticate", a.challenge)
+	}
+
+	a.succeed(addr)
+	if a.config.StripHeader {
+		req.Header.Del("Authorization")
+	}
+	return nil
+}
+
+// lookup returns the hash of the password of the user, reading the file
+// again if it has changed since the last check.
+func (a *basicAuth) lookup(user string) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if now := time.Now(); now.Sub(a.checked) >= htpasswdCheckInterval {
+		a.checked = now
+		if err := a.reload(); err != nil {
+			log.Printf("%s => htpasswd file could not be read, keeping the last users: %s", a.name, err)
+		}
+	}
+
+	hash, ok := a.users[user]
+	return hash, ok
+}
+
+// reload reads the file if it has changed, the users are only replaced if
+// the file is valid.
+func (a *basicAuth) reload() error {
+	info, err := os.Stat(a.config.File)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(a.modTime) && info.Size() == a.size {
+		return nil
+	}
+
+	users, err := readHtpasswd(a.config.File)
+	if err != nil {
+		return err
+	}
+	if a.users != nil {
+		log.Printf("%s => htpasswd file reloaded, %d users", a.name, len(users))
+	}
+	a.users = users
+	a.modTime = info.ModTime()
+	a.size = info.Size()
+	return nil
+}
+
+// locked reports if the client is locked out and for how long.
+func (a *basicAuth) locked(addr netip.Addr) (time.Duration, bool) {
+	if a.config.MaxFailures == 0 {
+		return 0, false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	element, ok := a.failures[addr]
+	if !ok {
+		return 0, false
+	}
+	failures := element.Value.(*authFailures)
+	if failures.count < a.config.MaxFailures {
+		return 0, false
+	}
+	remaining := a.config.Lockout - time.Since(failures.first)
+	return remaining, remaining > 0
+}
+
+func (a *basicAuth) fail(addr netip.Addr) {
+	if a.config.MaxFailures == 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	var failures *authFailures
+	if element, ok := a.failures[addr]; ok {
+		a.lru.MoveToFront(element)
+		failures = element.Value.(*authFailures)
+		if now.Sub(failures.first) >= a.config.Lockout {
+			failures.count = 0
+			failures.first = now
+		}
+	} else {
+		failures = &authFailures{addr: addr, first: now}
+		a.failures[addr] = a.lru.PushFront(failures)
+
+		if a.lru.Len() > maxAuthClients {
+			oldest := a.lru.Back()
+			a.lru.Remove(oldest)
+			delete(a.failures, oldest.Value.(*authFailures).addr)
+		}
+	}
+
+	failures.count++
+	if failures.count == a.config.MaxFailures {
+		log.Printf(
+			"%s => Client %s locked out for %s after %d failed authentications",
+			a.name, addr, a.config.Lockout, failures.count,
+		)
+	}
+}
+
+func (a *basicAuth) succeed(addr netip.Addr) {
+	if a.config.MaxFailures == 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if element, ok := a.failures[addr]; ok {
+		a.lru.Remove(element)
+		delete(a.failures, addr)
+	}
+}
+
+// readHtpasswd reads the users of a htpasswd file, the empty lines and the
+// comments starting with # are ignored.
+func readHtpasswd(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d of %s is not valid", line, path)
+		}
+		if !supportedHash(hash) {
+			return nil, fmt.Errorf("line %d of %s: unsupported password hash", line, path)
+		}
+		users[user] = hash
+	}
+	return users, scanner.Err()
+}
+
+// supportedHash reports if the hash is bcrypt, SHA1 or APR1 MD5.
+func supportedHash(hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"),
+		strings.HasPrefix(hash, "$2y$"):
+		_, err := bcrypt.Cost([]byte(hash))
+		return err == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		return true
+	case strings.HasPrefix(hash, "$apr1$"):
+		return strings.Count(hash, "$") == 3
+	}
+	return false
+}
+
+// verifyPassword compares the password with the hash in constant time, an
+// empty hash never matches.
+func verifyPassword(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(hash[len("$apr1$"):], "$")
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(apr1(password, salt))) == 1
+	}
+	return false
+}
+
+// apr1 hashes the password with the MD5 variant of Apache.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alternate := md5.Sum([]byte(password + salt + password))
+	hash := md5.New()
+	hash.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			hash.Write(alternate[:])
+		} else {
+			hash.Write(alternate[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			hash.Write([]byte{0})
+		} else {
+			hash.Write(pw[:1])
+		}
+	}
+	sum := hash.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 == 1 {
+			round.Write(pw)
+		} else {
+			round.Write(sum)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 == 1 {
+			round.Write(sum)
+		} else {
+			round.Write(pw)
+		}
+		sum = round.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out strings.Builder
+	encode := func(value uint, chars int) {
+		for ; chars > 0; chars-- {
+			out.WriteByte(itoa64[value&0x3f])
+			value >>= 6
+		}
+	}
+	for _, group := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(sum[group[0]])<<16|uint(sum[group[1]])<<8|uint(sum[group[2]]), 4)
+	}
+	encode(uint(sum[11]), 2)
+	return magic + salt + "$" + out.String()
+}
+
+func newBasicAuth(name string, config *config.BasicAuth) (*basicAuth, error) {
+	auth := &basicAuth{
+		name:      name,
+		config:    config,
+		challenge: fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, config.Realm),
+		failures:  make(map[netip.Addr]*list.Element),
+		lru:       list.New(),
+	}
+	if err := auth.reload(); err != nil {
+		return nil, fmt.Errorf("htpasswd file of %s: %w", name, err)
+	}
+	auth.checked = time.Now()
+	return auth, nil
+}
@@ -0,0 +1,116 @@
+package grx
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/MAD-py/grx/pkg/config"
+)
+
+// limitBody makes the reads of the request body fail once it exceeds the
+// maximum size, so that chunked bodies are also limited.
+func limitBody(req *http.Request, maxSize int64) {
+	if body, ok := req.Body.(*clientBody); ok {
+		body.ReadCloser = http.MaxBytesReader(nil, body.ReadCloser, maxSize)
+	}
+}
+
+// bodyTooLarge reports if the error was caused by a body over the limit.
+func bodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// clientBody marks the errors reading the body of the client request, so
+// that they are not taken as failures of the server.
+type clientBody struct {
+	io.ReadCloser
+}
+
+func (b *clientBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = &clientBodyError{err: err}
+	}
+	return n, err
+}
+
+// clientBodyError is an error reading the body of the client request.
+type clientBodyError struct {
+	err error
+}
+
+func (e *clientBodyError) Error() string { return "client body: " + e.err.Error() }
+
+func (e *clientBodyError) Unwrap() error { return e.err }
+
+// clientFailure returns the error of the client if the request could not
+// be sent because of its body.
+func clientFailure(err error) (error, bool) {
+	var bodyErr *clientBodyError
+	if errors.As(err, &bodyErr) {
+		return bodyErr.err, true
+	}
+	return nil, false
+}
+
+// spoolBody reads the whole body of the request before it is forwarded,
+// keeping it in memory if it is small or in a temporary file otherwise.
+// The returned function removes the file once the request is finished.
+func spoolBody(req *http.Request, spool *config.Spool) (func(), error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return func() {}, nil
+	}
+	defer req.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(req.Body, spool.MemorySize+1))
+	if err != nil {
+		return func() {}, err
+	}
+
+	if int64(len(data)) <= spool.MemorySize {
+		setBody(req, int64(len(data)), func() io.Reader {
+			return bytes.NewReader(data)
+		})
+		return func() {}, nil
+	}
+
+	file, err := os.CreateTemp(spool.Dir, "grx-body-")
+	if err != nil {
+		return func() {}, err
+	}
+	remove := func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+
+	if _, err := file.Write(data); err != nil {
+		remove()
+		return func() {}, err
+	}
+	size, err := io.Copy(file, req.Body)
+	if err != nil {
+		remove()
+		return func() {}, err
+	}
+
+	size += int64(len(data))
+	setBody(req, size, func() io.Reader {
+		return io.NewSectionReader(file, 0, size)
+	})
+	return remove, nil
+}
+
+// setBody replaces the body of the request by one of known size that can
+// be read again with GetBody.
+func setBody(req *http.Request, size int64, reader func() io.Reader) {
+	req.ContentLength = size
+	req.TransferEncoding = nil
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(reader()), nil
+	}
+	req.Body, _ = req.GetBody()
+}
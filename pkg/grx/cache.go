@@ -0,0 +1,591 @@
+package grx
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MAD-py/grx/pkg/config"
+	"github.com/MAD-py/grx/pkg/errors"
+)
+
+// heuristicStatus are the status codes whose responses can be cached
+// without an explicit expiration.
+var heuristicStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// responseCache keeps the responses of the GET requests in memory as a
+// shared cache, following the Cache-Control of the requests and of the
+// responses. The stale responses are revalidated with conditional
+// requests and the least recently used are removed when it is full.
+type responseCache struct {
+	config *config.Cache
+
+	mu sync.Mutex
+
+	// Responses from the most to the least recently used.
+	lru *list.List
+
+	items map[string]*cacheItem
+
+	// Size of all the responses.
+	size int64
+}
+
+// cacheItem contains the responses of a key, one for each combination of
+// the values of the headers in the Vary of the server.
+type cacheItem struct {
+	vary []string
+
+	responses map[string]*list.Element
+}
+
+// cachedResponse is a stored response, it is never modified so it can be
+// used after it is removed from the cache.
+type cachedResponse struct {
+	key     string
+	variant string
+
+	statusCode int
+	header     http.Header
+	body       []byte
+
+	// Time the response was received and its age at that moment.
+	received   time.Time
+	initialAge time.Duration
+
+	// Time the response is fresh since it was generated.
+	lifetime time.Duration
+
+	// The response must be revalidated before each use.
+	noCache bool
+
+	size int64
+}
+
+// roundTrip answers the request with a fresh response of the cache,
+// otherwise fetch gets the response from the servers, revalidating the
+// stale one if possible, and the response is stored if it is cacheable.
+// The X-Cache header of the responses to GET requests tells the origin of
+// the response. The responses of each group are stored apart, and those of
+// the authenticated requests are stored like the ones with Authorization,
+// as the server may have removed it or added headers of the user.
+func (c *responseCache) roundTrip(
+	req *http.Request, group string, authenticated bool,
+	fetch func(*http.Request) (*http.Response, *errors.ProxyError),
+) (*http.Response, *errors.ProxyError) {
+	if req.Method != http.MethodGet {
+		res, proxyErr := fetch(req)
+		// The unsafe methods can change the resource, so its responses
+		// are no longer valid.
+		if proxyErr == nil && !safeMethod(req.Method) && res.StatusCode < 400 {
+			c.invalidate(c.key(req))
+		}
+		return res, proxyErr
+	}
+
+	reqCC := parseCacheControl(req.Header)
+	if len(req.Header.Values("Cache-Control")) == 0 &&
+		strings.Contains(strings.ToLower(req.Header.Get("Pragma")), "no-cache") {
+		reqCC["no-cache"] = ""
+	}
+	if reqCC.has("no-store") || req.Header.Get("Range") != "" {
+		res, proxyErr := fetch(req)
+		if proxyErr == nil {
+			res.Header.Set("X-Cache", "MISS")
+		}
+		return res, proxyErr
+	}
+
+	key := c.key(req)
+	cached := c.lookup(key, group, req)
+	if cached != nil && cached.fresh(time.Now(), reqCC) {
+		return cached.response(req, time.Now(), "HIT"), nil
+	}
+	if reqCC.has("only-if-cached") {
+		return nil, errors.GatewayTimeout()
+	}
+
+	status := "MISS"
+	forwarded := req
+	if cached != nil {
+		status = "EXPIRED"
+		forwarded = cached.conditional(req)
+	}
+
+	res, proxyErr := fetch(forwarded)
+	if proxyErr != nil {
+		return nil, proxyErr
+	}
+	received := time.Now()
+
+	if forwarded != req && res.StatusCode == http.StatusNotModified {
+		res.Body.Close()
+		updated := cached.update(res.Header, received, c.config.DefaultTTL)
+		c.store(updated, cached.varyOf())
+		return updated.response(req, received, status), nil
+	}
+
+	if !c.storable(req, res, authenticated) {
+		res.Header.Set("X-Cache", status)
+		return res, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, c.config.MaxEntrySize+1))
+	if err != nil {
+		res.Body.Close()
+		return nil, errors.BadGateway()
+	}
+	if int64(len(body)) > c.config.MaxEntrySize {
+		res.Body = &multiReadCloser{
+			Reader: io.MultiReader(bytes.NewReader(body), res.Body),
+			Closer: res.Body,
+		}
+		res.Header.Set("X-Cache", status)
+		return res, nil
+	}
+	res.Body.Close()
+
+	vary := varyHeaders(res.Header)
+	response := newCachedResponse(key, variantKey(group, req, vary), res, body, received, c.config.DefaultTTL)
+	c.store(response, vary)
+	return response.response(req, received, status), nil
+}
+
+// storable reports if the response of the request can be stored by a
+// shared cache and reused later.
+func (c *responseCache) storable(req *http.Request, res *http.Response, authenticated bool) bool {
+	cc := parseCacheControl(res.Header)
+	if cc.has("no-store") || cc.has("private") {
+		return false
+	}
+	for _, name := range varyHeaders(res.Header) {
+		if name == "*" {
+			return false
+		}
+	}
+	// The responses that set cookies are specific to a client.
+	if res.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+	if (authenticated || req.Header.Get("Authorization") != "") &&
+		!cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+	if res.ContentLength > c.config.MaxEntrySize {
+		return false
+	}
+
+	lifetime, explicit := freshness(res.StatusCode, res.Header, time.Now(), c.config.DefaultTTL)
+	if !heuristicStatus[res.StatusCode] && !(explicit &&
+		(res.StatusCode == http.StatusFound || res.StatusCode == http.StatusTemporaryRedirect)) {
+		return false
+	}
+	return (lifetime > 0 && !cc.has("no-cache")) || hasValidators(res.Header)
+}
+
+// key identifies the resource of the request with the configured parts,
+// the group is part of the variant so that the unsafe methods invalidate
+// the responses of all the groups.
+func (c *responseCache) key(req *http.Request) string {
+	var key strings.Builder
+	for _, part := range c.config.Key {
+		switch {
+		case part == "host":
+			key.WriteString(req.Host)
+		case part == "path":
+			key.WriteString(req.URL.EscapedPath())
+		case part == "query":
+			key.WriteString(req.URL.RawQuery)
+		case strings.HasPrefix(part, "header:"):
+			key.WriteString(strings.Join(req.Header.Values(part[len("header:"):]), ","))
+		case strings.HasPrefix(part, "cookie:"):
+			if cookie, err := req.Cookie(part[len("cookie:"):]); err == nil {
+				key.WriteString(cookie.Value)
+			}
+		}
+		key.WriteByte(0)
+	}
+	return key.String()
+}
+
+// lookup returns the response of the key and group that matches the Vary
+// of the request, nil if there is none.
+func (c *responseCache) lookup(key, group string, req *http.Request) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	item, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	element, ok := item.responses[variantKey(group, req, item.vary)]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	return element.Value.(*cachedResponse)
+}
+
+// store adds the response replacing the previous one of the same variant,
+// the responses with a different Vary are removed.
+func (c *responseCache) store(response *cachedResponse, vary []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if item, ok := c.items[response.key]; ok {
+		if !equalStrings(item.vary, vary) {
+			for _, element := range item.responses {
+				c.remove(element)
+			}
+		} else if element, ok := item.responses[response.variant]; ok {
+			c.remove(element)
+		}
+	}
+
+	item, ok := c.items[response.key]
+	if !ok {
+		item = &cacheItem{vary: vary, responses: make(map[string]*list.Element)}
+		c.items[response.key] = item
+	}
+	item.responses[response.variant] = c.lru.PushFront(response)
+	c.size += response.size
+
+	for c.size > c.config.MaxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate removes all the responses of the key.
+func (c *responseCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if item, ok := c.items[key]; ok {
+		for _, element := range item.responses {
+			c.remove(element)
+		}
+	}
+}
+
+func (c *responseCache) remove(element *list.Element) {
+	response := c.lru.Remove(element).(*cachedResponse)
+	c.size -= response.size
+
+	item := c.items[response.key]
+	delete(item.responses, response.variant)
+	if len(item.responses) == 0 {
+		delete(c.items, response.key)
+	}
+}
+
+func (r *cachedResponse) age(now time.Time) time.Duration {
+	return r.initialAge + now.Sub(r.received)
+}
+
+// fresh reports if the response can be used without revalidating it,
+// according to its lifetime and the Cache-Control of the request.
+func (r *cachedResponse) fresh(now time.Time, reqCC cacheControl) bool {
+	if r.noCache || reqCC.has("no-cache") {
+		return false
+	}
+
+	age := r.age(now)
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := reqCC.seconds("min-fresh"); ok && r.lifetime-age < minFresh {
+		return false
+	}
+	return age < r.lifetime
+}
+
+// conditional returns the request to revalidate the response with its
+// validators, the request itself if the response has none.
+func (r *cachedResponse) conditional(req *http.Request) *http.Request {
+	etag := r.header.Get("ETag")
+	lastModified := r.header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return req
+	}
+
+	forwarded := req.Clone(req.Context())
+	forwarded.Header.Del("If-None-Match")
+	forwarded.Header.Del("If-Modified-Since")
+	if etag != "" {
+		forwarded.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		forwarded.Header.Set("If-Modified-Since", lastModified)
+	}
+	return forwarded
+}
+
+// update returns the response revalidated by a 304, with the headers of
+// the 304 replacing the stored ones.
+func (r *cachedResponse) update(header http.Header, received time.Time, defaultTTL time.Duration) *cachedResponse {
+	updated := r.header.Clone()
+	for key, values := range header {
+		if key != "Content-Length" {
+			updated[key] = values
+		}
+	}
+	return newStoredResponse(r.key, r.variant, r.statusCode, updated, r.body, received, defaultTTL)
+}
+
+// varyOf returns the names of the headers in the Vary of the response.
+func (r *cachedResponse) varyOf() []string { return varyHeaders(r.header) }
+
+// response creates the response sent to the client, a 304 if the
+// conditions of the request are met by the stored response.
+func (r *cachedResponse) response(req *http.Request, now time.Time, status string) *http.Response {
+	header := r.header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(r.age(now)/time.Second), 10))
+	header.Set("X-Cache", status)
+
+	res := &http.Response{
+		Status:     http.StatusText(r.statusCode),
+		StatusCode: r.statusCode,
+
+		Proto:      req.Proto,
+		ProtoMajor: req.ProtoMajor,
+		ProtoMinor: req.ProtoMinor,
+
+		Header: header,
+
+		Body:          io.NopCloser(bytes.NewReader(r.body)),
+		ContentLength: int64(len(r.body)),
+	}
+	if r.statusCode == http.StatusOK && notModified(req, header) {
+		res.Status = http.StatusText(http.StatusNotModified)
+		res.StatusCode = http.StatusNotModified
+		res.Body = http.NoBody
+		res.ContentLength = 0
+	}
+	return res
+}
+
+func newCachedResponse(
+	key, variant string, res *http.Response, body []byte, received time.Time, defaultTTL time.Duration,
+) *cachedResponse {
+	return newStoredResponse(key, variant, res.StatusCode, res.Header, body, received, defaultTTL)
+}
+
+func newStoredResponse(
+	key, variant string, statusCode int, header http.Header, body []byte,
+	received time.Time, defaultTTL time.Duration,
+) *cachedResponse {
+	// The hop-by-hop headers are not stored.
+	header = header.Clone()
+	for _, name := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Trailer", "Transfer-Encoding", "Upgrade", "X-Cache"} {
+		header.Del(name)
+	}
+
+	lifetime, _ := freshness(statusCode, header, received, defaultTTL)
+	size := int64(len(key) + len(variant) + len(body))
+	for name, values := range header {
+		for _, value := range values {
+			size += int64(len(name) + len(value))
+		}
+	}
+
+	return &cachedResponse{
+		key:        key,
+		variant:    variant,
+		statusCode: statusCode,
+		header:     header,
+		body:       body,
+		received:   received,
+		initialAge: initialAge(header, received),
+		lifetime:   lifetime,
+		noCache:    parseCacheControl(header).has("no-cache"),
+		size:       size,
+	}
+}
+
+// freshness returns the time the response is fresh since it was generated
+// and if it was set explicitly by the server. Without an explicit one, it
+// is 10% of the time since the last modification or the default TTL.
+func freshness(
+	statusCode int, header http.Header, received time.Time, defaultTTL time.Duration,
+) (time.Duration, bool) {
+	cc := parseCacheControl(header)
+	if sMaxAge, ok := cc.seconds("s-maxage"); ok {
+		return sMaxAge, true
+	}
+	if maxAge, ok := cc.seconds("max-age"); ok {
+		return maxAge, true
+	}
+
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		date = received
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		// An invalid date means that the response has already expired.
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil || !expiresAt.After(date) {
+			return 0, true
+		}
+		return expiresAt.Sub(date), true
+	}
+
+	if !heuristicStatus[statusCode] {
+		return 0, false
+	}
+	if lastModified, err := http.ParseTime(header.Get("Last-Modified")); err == nil && date.After(lastModified) {
+		return date.Sub(lastModified) / 10, false
+	}
+	return defaultTTL, false
+}
+
+// initialAge returns the age of the response when it was received, from
+// its Age and Date headers.
+func initialAge(header http.Header, received time.Time) time.Duration {
+	var age time.Duration
+	if seconds, err := strconv.Atoi(header.Get("Age")); err == nil && seconds > 0 {
+		age = time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header.Get("Date")); err == nil && received.Sub(date) > age {
+		age = received.Sub(date)
+	}
+	return age
+}
+
+// notModified reports if the validators of the response meet the
+// conditions of the request.
+func notModified(req *http.Request, header http.Header) bool {
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !lastModified.After(since)
+}
+
+func hasValidators(header http.Header) bool {
+	return header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+}
+
+// varyHeaders returns the names of the headers in the Vary of the
+// response.
+func varyHeaders(header http.Header) []string {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// variantKey identifies the group and the values of the request for the
+// headers of the Vary.
+func variantKey(group string, req *http.Request, vary []string) string {
+	var key strings.Builder
+	key.WriteString(group)
+	key.WriteByte(0)
+	for _, name := range vary {
+		key.WriteString(name)
+		key.WriteByte(':')
+		key.WriteString(strings.Join(req.Header.Values(name), ","))
+		key.WriteByte(0)
+	}
+	return key.String()
+}
+
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// cacheControl contains the directives of the Cache-Control headers by
+// name, with their argument if they have one.
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, argument, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				cc[name] = strings.Trim(strings.TrimSpace(argument), `"`)
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns the argument of the directive as a duration, false if
+// the directive is missing or its argument is not valid.
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	argument, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(argument)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+func newResponseCache(config *config.Cache) *responseCache {
+	return &responseCache{
+		config: config,
+		lru:    list.New(),
+		items:  make(map[string]*cacheItem),
+	}
+}
@@ -0,0 +1,312 @@
+package grx
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/MAD-py/grx/pkg/config"
+	"github.com/MAD-py/grx/pkg/errors"
+)
+
+// origin is a stand-in for the servers behind the cache.
+type origin struct {
+	respond func(req *http.Request) (int, http.Header, string)
+
+	// Requests received.
+	requests []*http.Request
+}
+
+func (o *origin) fetch(req *http.Request) (*http.Response, *errors.ProxyError) {
+	o.requests = append(o.requests, req)
+	status, header, body := o.respond(req)
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		StatusCode:    status,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}, nil
+}
+
+// fixed responds to every request with the status, body and headers.
+func fixed(status int, body string, headers ...string) func(*http.Request) (int, http.Header, string) {
+	return func(*http.Request) (int, http.Header, string) {
+		header := http.Header{}
+		for i := 0; i+1 < len(headers); i += 2 {
+			header.Add(headers[i], headers[i+1])
+		}
+		return status, header, body
+	}
+}
+
+func newTestCache(maxSize int64) *responseCache {
+	return newResponseCache(&config.Cache{
+		MaxSize:      maxSize,
+		MaxEntrySize: 1 << 20,
+		Key:          []string{"host", "path", "query"},
+	})
+}
+
+// send passes a request of the group through the cache and returns the
+// response with its body read.
+func send(
+	t *testing.T, c *responseCache, o *origin, method, path, group string,
+	authenticated bool, headers ...string,
+) (*http.Response, string) {
+	t.Helper()
+	req := httptest.NewRequest(method, "http://grx.test"+path, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	res, proxyErr := c.roundTrip(req, group, authenticated, o.fetch)
+	if proxyErr != nil {
+		t.Fatalf("%s %s failed with %d", method, path, proxyErr.StatusCode())
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res, string(body)
+}
+
+func get(t *testing.T, c *responseCache, o *origin, path string, headers ...string) (*http.Response, string) {
+	t.Helper()
+	return send(t, c, o, http.MethodGet, path, "api", false, headers...)
+}
+
+func TestCacheFreshness(t *testing.T) {
+	c := newTestCache(1 << 20)
+	o := &origin{respond: fixed(http.StatusOK, "fresh", "Cache-Control", "max-age=60")}
+
+	for i, want := range []string{"MISS", "HIT", "HIT"} {
+		res, body := get(t, c, o, "/fresh")
+		if got := res.Header.Get("X-Cache"); got != want {
+			t.Errorf("request %d: X-Cache = %s, want %s", i, got, want)
+		}
+		if body != "fresh" {
+			t.Errorf("request %d: body = %q", i, body)
+		}
+	}
+	if len(o.requests) != 1 {
+		t.Errorf("origin received %d requests, want 1", len(o.requests))
+	}
+
+	// The client can ask for a response revalidated or younger than its age.
+	get(t, c, o, "/fresh", "Cache-Control", "no-cache")
+	if len(o.requests) != 2 {
+		t.Errorf("no-cache request answered from the cache")
+	}
+
+	// A response whose age is already over its lifetime is stale.
+	o.respond = fixed(http.StatusOK, "stale", "Cache-Control", "max-age=10", "Age", "20")
+	get(t, c, o, "/stale")
+	res, _ := get(t, c, o, "/stale")
+	if got := res.Header.Get("X-Cache"); got != "EXPIRED" {
+		t.Errorf("stale response X-Cache = %s, want EXPIRED", got)
+	}
+	if len(o.requests) != 4 {
+		t.Errorf("origin received %d requests, want 4", len(o.requests))
+	}
+
+	// The responses that can not be shared are not stored.
+	for _, header := range [][]string{
+		{"Cache-Control", "no-store, max-age=60"},
+		{"Cache-Control", "private, max-age=60"},
+		{"Cache-Control", "max-age=60", "Set-Cookie", "session=1"},
+		{"Cache-Control", "max-age=60", "Vary", "*"},
+	} {
+		o.respond = fixed(http.StatusOK, "private", header...)
+		o.requests = nil
+		get(t, c, o, "/private")
+		get(t, c, o, "/private")
+		if len(o.requests) != 2 {
+			t.Errorf("response with %v was stored", header)
+		}
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	c := newTestCache(1 << 20)
+	o := &origin{respond: func(req *http.Request) (int, http.Header, string) {
+		header := http.Header{}
+		header.Set("Cache-Control", "max-age=60")
+		header.Set("Vary", "Accept-Encoding")
+		return http.StatusOK, header, "encoding " + req.Header.Get("Accept-Encoding")
+	}}
+
+	for i, test := range []struct {
+		encoding string
+		status   string
+	}{
+		{"gzip", "MISS"},
+		{"br", "MISS"},
+		{"gzip", "HIT"},
+		{"br", "HIT"},
+	} {
+		res, body := get(t, c, o, "/vary", "Accept-Encoding", test.encoding)
+		if got := res.Header.Get("X-Cache"); got != test.status {
+			t.Errorf("request %d: X-Cache = %s, want %s", i, got, test.status)
+		}
+		if body != "encoding "+test.encoding {
+			t.Errorf("request %d: body = %q for %s", i, body, test.encoding)
+		}
+	}
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	c := newTestCache(1 << 20)
+	o := &origin{respond: func(req *http.Request) (int, http.Header, string) {
+		header := http.Header{}
+		header.Set("ETag", `"v1"`)
+		header.Set("Cache-Control", "no-cache")
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			header.Set("X-Revalidated", "yes")
+			return http.StatusNotModified, header, ""
+		}
+		return http.StatusOK, header, "body v1"
+	}}
+
+	get(t, c, o, "/etag")
+	res, body := get(t, c, o, "/etag")
+	if got := o.requests[1].Header.Get("If-None-Match"); got != `"v1"` {
+		t.Fatalf("revalidation If-None-Match = %q, want the stored ETag", got)
+	}
+	if res.StatusCode != http.StatusOK || body != "body v1" {
+		t.Errorf("revalidated response = %d %q, want the stored one", res.StatusCode, body)
+	}
+	if got := res.Header.Get("X-Cache"); got != "EXPIRED" {
+		t.Errorf("X-Cache = %s, want EXPIRED", got)
+	}
+	if res.Header.Get("X-Revalidated") != "yes" {
+		t.Error("headers of the 304 not merged into the stored response")
+	}
+
+	// The conditional requests of the clients are answered with a 304.
+	res, body = get(t, c, o, "/etag", "If-None-Match", `"v1"`)
+	if res.StatusCode != http.StatusNotModified || body != "" {
+		t.Errorf("conditional request = %d %q, want an empty 304", res.StatusCode, body)
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	c := newTestCache(1 << 20)
+	o := &origin{respond: fixed(http.StatusOK, "resource", "Cache-Control", "max-age=60")}
+
+	get(t, c, o, "/resource")
+	if res, _ := get(t, c, o, "/resource"); res.Header.Get("X-Cache") != "HIT" {
+		t.Fatal("response not stored")
+	}
+
+	// A failed request does not change the resource.
+	o.respond = fixed(http.StatusInternalServerError, "")
+	send(t, c, o, http.MethodPost, "/resource", "api", false)
+	o.respond = fixed(http.StatusOK, "resource", "Cache-Control", "max-age=60")
+	if res, _ := get(t, c, o, "/resource"); res.Header.Get("X-Cache") != "HIT" {
+		t.Error("response removed after a failed POST")
+	}
+
+	// The responses of every group are removed, as the unsafe request may
+	// be sent to another group.
+	send(t, c, o, http.MethodGet, "/resource", "canary", false)
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch} {
+		send(t, c, o, method, "/resource", "api", false)
+		for _, group := range []string{"api", "canary"} {
+			res, _ := send(t, c, o, http.MethodGet, "/resource", group, false)
+			if got := res.Header.Get("X-Cache"); got != "MISS" {
+				t.Errorf("X-Cache of %s after %s = %s, want MISS", group, method, got)
+			}
+		}
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	body := strings.Repeat("x", 1000)
+	c := newTestCache(2500)
+	o := &origin{respond: fixed(http.StatusOK, body, "Cache-Control", "max-age=60")}
+
+	get(t, c, o, "/a")
+	get(t, c, o, "/b")
+	// The use of a makes b the least recently used.
+	get(t, c, o, "/a")
+	get(t, c, o, "/c")
+
+	for _, test := range []struct {
+		path   string
+		status string
+	}{
+		{"/a", "HIT"},
+		{"/c", "HIT"},
+		{"/b", "MISS"},
+	} {
+		res, _ := get(t, c, o, test.path)
+		if got := res.Header.Get("X-Cache"); got != test.status {
+			t.Errorf("X-Cache of %s = %s, want %s", test.path, got, test.status)
+		}
+	}
+	if c.size > c.config.MaxSize {
+		t.Errorf("size = %d, over the maximum of %d", c.size, c.config.MaxSize)
+	}
+
+	// A response larger than the cache is sent but not stored.
+	o.respond = fixed(http.StatusOK, strings.Repeat("x", 3000), "Cache-Control", "max-age=60")
+	if _, body := get(t, c, o, "/big"); len(body) != 3000 {
+		t.Errorf("body of the large response has %d bytes", len(body))
+	}
+	if c.size > c.config.MaxSize {
+		t.Errorf("size = %d, over the maximum of %d", c.size, c.config.MaxSize)
+	}
+}
+
+func TestCacheGroups(t *testing.T) {
+	c := newTestCache(1 << 20)
+	o := &origin{}
+	o.respond = func(*http.Request) (int, http.Header, string) {
+		header := http.Header{}
+		header.Set("Cache-Control", "max-age=60")
+		return http.StatusOK, header, strconv.Itoa(len(o.requests))
+	}
+
+	_, api := send(t, c, o, http.MethodGet, "/", "api", false)
+	res, canary := send(t, c, o, http.MethodGet, "/", "canary", false)
+	if res.Header.Get("X-Cache") != "MISS" || canary == api {
+		t.Errorf("canary answered with the response of api")
+	}
+	if _, body := send(t, c, o, http.MethodGet, "/", "api", false); body != api {
+		t.Errorf("api body = %q, want %q", body, api)
+	}
+}
+
+func TestCacheAuthenticated(t *testing.T) {
+	for _, test := range []struct {
+		cacheControl string
+		stored       bool
+	}{
+		{"max-age=60", false},
+		{"public, max-age=60", true},
+		{"s-maxage=60", true},
+	} {
+		c := newTestCache(1 << 20)
+		o := &origin{respond: fixed(http.StatusOK, "user", "Cache-Control", test.cacheControl)}
+
+		// The authentication may have removed the Authorization header.
+		send(t, c, o, http.MethodGet, "/me", "api", true)
+		send(t, c, o, http.MethodGet, "/me", "api", true)
+		if stored := len(o.requests) == 1; stored != test.stored {
+			t.Errorf("authenticated response with %s stored = %t", test.cacheControl, stored)
+		}
+
+		o.requests = nil
+		send(t, c, o, http.MethodGet, "/other", "api", false, "Authorization", "Bearer token")
+		send(t, c, o, http.MethodGet, "/other", "api", false, "Authorization", "Bearer token")
+		if stored := len(o.requests) == 1; stored != test.stored {
+			t.Errorf("response with Authorization and %s stored = %t", test.cacheControl, stored)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package grx
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/MAD-py/grx/pkg/errors"
+)
+
+// readRequest reads the request of the client applying the deadlines and
+// limits of the server. If both the request and the error are nil the
+// connection must be closed without a response.
+func (s *baseServer) readRequest(conn *net.TCPConn) (*http.Request, *errors.ProxyError) {
+	limits := s.clientLimits
+	reader := &headerReader{
+		Reader:    conn,
+		remaining: limits.MaxHeaderSize,
+		active:    limits.MaxHeaderSize > 0,
+	}
+	// The headers fit in the buffer, without a limit the lines longer
+	// than the default size are read in several steps.
+	buffered := bufio.NewReader(reader)
+	if limits.MaxHeaderSize > 0 && limits.MaxHeaderSize < maxRequestSize {
+		buffered = bufio.NewReaderSize(reader, int(limits.MaxHeaderSize))
+	}
+
+	if limits.IdleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(limits.IdleTimeout))
+		if _, err := buffered.Peek(1); err != nil {
+			return nil, nil
+		}
+	}
+
+	if limits.HeaderTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(limits.HeaderTimeout))
+	}
+	req, err := http.ReadRequest(buffered)
+	if err != nil {
+		if reader.exceeded() {
+			return nil, errors.RequestHeaderFieldsTooLarge()
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil, errors.RequestTimeout()
+		}
+		return nil, errors.BadRequest()
+	}
+	reader.active = false
+
+	if limits.MaxHeaders > 0 {
+		headers := 0
+		for _, values := range req.Header {
+			headers += len(values)
+		}
+		if headers > limits.MaxHeaders {
+			return req, errors.RequestHeaderFieldsTooLarge()
+		}
+	}
+
+	var deadline time.Time
+	if limits.BodyTimeout > 0 {
+		deadline = time.Now().Add(limits.BodyTimeout)
+	}
+	conn.SetReadDeadline(deadline)
+
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &clientBody{ReadCloser: req.Body}
+	}
+	return req, nil
+}
+
+// headerReader limits the bytes read from the connection until the
+// headers of the request are read.
+type headerReader struct {
+	io.Reader
+
+	// Bytes that can still be read while the limit is active.
+	remaining int64
+
+	// The limit is applied, it is removed once the headers are read.
+	active bool
+}
+
+func (r *headerReader) Read(p []byte) (int, error) {
+	if !r.active {
+		return r.Reader.Read(p)
+	}
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.Reader.Read(p)
+	r.remaining -= int64(n)
+	return n, err
+}
+
+// exceeded reports if the limit was reached while reading the headers.
+func (r *headerReader) exceeded() bool { return r.active && r.remaining == 0 }
@@ -0,0 +1,215 @@
+package grx
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/MAD-py/grx/pkg/config"
+
+	proxyHTTP "github.com/MAD-py/grx/pkg/http"
+)
+
+// cors answers the preflight requests of the allowed origins and adds the
+// CORS headers to the responses sent to them.
+type cors struct {
+	config *config.CORS
+
+	// Values of the headers that do not depend on the request, headers is
+	// empty if the requested headers are allowed.
+	methods       string
+	headers       string
+	exposeHeaders string
+	maxAge        string
+
+	// Any origin is allowed and "*" is sent instead of the origin.
+	anyOrigin bool
+}
+
+// preflight returns the response of the request if it is a preflight
+// request, the ones of origins that are not allowed receive a 403.
+func (c *cors) preflight(req *http.Request) (*proxyHTTP.ProxyResponse, bool) {
+	origin := req.Header.Get("Origin")
+	method := req.Header.Get("Access-Control-Request-Method")
+	if req.Method != http.MethodOptions || origin == "" || method == "" {
+		return nil, false
+	}
+
+	if !c.allowed(origin) || !c.allowedMethod(method) ||
+		!c.allowedHeaders(req.Header.Get("Access-Control-Request-Headers")) {
+		return proxyHTTP.NewEmptyProxyResponse(req, http.StatusForbidden), true
+	}
+
+	response := proxyHTTP.NewEmptyProxyResponse(req, http.StatusNoContent)
+	header := response.Header()
+	c.setOrigin(header, origin)
+	header.Set("Access-Control-Allow-Methods", c.methods)
+	if c.headers != "" {
+		header.Set("Access-Control-Allow-Headers", c.headers)
+	} else if requested := req.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		header.Set("Access-Control-Allow-Headers", requested)
+	}
+	if c.maxAge != "" {
+		header.Set("Access-Control-Max-Age", c.maxAge)
+	}
+	c.vary(header)
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+	return response, true
+}
+
+// apply adds the CORS headers to the response of the request, replacing
+// the ones of the server unless they are merged.
+func (c *cors) apply(req *http.Request, header http.Header) {
+	if !c.config.Merge {
+		for key := range header {
+			if strings.HasPrefix(key, "Access-Control-") {
+				delete(header, key)
+			}
+		}
+	}
+
+	c.vary(header)
+	origin := req.Header.Get("Origin")
+	if origin == "" || !c.allowed(origin) {
+		return
+	}
+
+	if !c.config.Merge || header.Get("Access-Control-Allow-Origin") == "" {
+		c.setOrigin(header, origin)
+	}
+	if c.exposeHeaders != "" &&
+		(!c.config.Merge || header.Get("Access-Control-Expose-Headers") == "") {
+		header.Set("Access-Control-Expose-Headers", c.exposeHeaders)
+	}
+}
+
+// setOrigin sets the allowed origin, which is the origin of the request
+// unless any origin is allowed without credentials.
+func (c *cors) setOrigin(header http.Header, origin string) {
+	if c.anyOrigin && !c.config.Credentials {
+		header.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+
+	header.Set("Access-Control-Allow-Origin", origin)
+	if c.config.Credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// vary marks the response as dependent on the origin when the allowed
+// origin is not "*", so that the caches do not mix the responses of
+// different origins.
+func (c *cors) vary(header http.Header) {
+	if c.anyOrigin && !c.config.Credentials {
+		return
+	}
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), "Origin") {
+				return
+			}
+		}
+	}
+	header.Add("Vary", "Origin")
+}
+
+// allowed reports if the origin is one of the allowed ones, matches a
+// wildcard subdomain or one of the patterns.
+func (c *cors) allowed(origin string) bool {
+	if c.anyOrigin {
+		return true
+	}
+
+	lower := strings.ToLower(origin)
+	for _, allowed := range c.config.Origins {
+		if allowed == lower {
+			return true
+		}
+
+		prefix, suffix, ok := strings.Cut(allowed, "*")
+		if !ok || !strings.HasSuffix(lower, suffix) {
+			continue
+		}
+		// Without scheme in the pattern any scheme is allowed.
+		rest := lower
+		if prefix != "" {
+			if !strings.HasPrefix(lower, prefix) {
+				continue
+			}
+			rest = lower[len(prefix):]
+		} else if _, host, ok := strings.Cut(lower, "://"); ok {
+			rest = host
+		}
+		subdomain := rest[:len(rest)-len(suffix)]
+		if subdomain != "" && !strings.ContainsAny(subdomain, "/:") {
+			return true
+		}
+	}
+
+	for _, pattern := range c.config.OriginPatterns {
+		if pattern.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cors) allowedMethod(method string) bool {
+	for _, allowed := range c.config.Methods {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedHeaders reports if all the requested headers are allowed.
+func (c *cors) allowedHeaders(requested string) bool {
+	if len(c.config.Headers) == 0 || requested == "" {
+		return true
+	}
+
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+		allowed := false
+		for _, h := range c.config.Headers {
+			if h == "*" || strings.EqualFold(h, header) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+func newCORS(config *config.CORS) *cors {
+	c := &cors{
+		config:        config,
+		methods:       strings.Join(config.Methods, ", "),
+		headers:       strings.Join(config.Headers, ", "),
+		exposeHeaders: strings.Join(config.ExposeHeaders, ", "),
+	}
+	if config.MaxAge > 0 {
+		c.maxAge = seconds(config.MaxAge)
+	}
+	for _, origin := range config.Origins {
+		if origin == "*" {
+			c.anyOrigin = true
+		}
+	}
+	// "*" is not a wildcard for requests with credentials, so the
+	// requested headers are sent back instead.
+	for _, header := range config.Headers {
+		if header == "*" {
+			c.headers = ""
+		}
+	}
+	return c
+}
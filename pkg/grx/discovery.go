@@ -0,0 +1,97 @@
+package grx
+
+import (
+	"log"
+	"sync"
+
+	"github.com/MAD-py/grx/pkg/config"
+	"github.com/MAD-py/grx/pkg/discovery"
+)
+
+// discoverer combines the static forwards of a server with the forwards
+// found by each source, every time a source finds changes the whole list
+// is sent to update.
+type discoverer struct {
+	// Name of the server that will be visible in the logs
+	name string
+
+	sources []discovery.Source
+
+	mu sync.Mutex
+
+	static []*config.Forward
+
+	// Last forwards found by each source.
+	found [][]*config.Forward
+
+	// Called with all the forwards each time they change.
+	update func([]*config.Forward)
+
+	// Closed to stop all the sources.
+	stop chan struct{}
+}
+
+// run starts watching all the sources in the background.
+func (d *discoverer) run() {
+	for i, source := range d.sources {
+		go d.watch(i, source)
+	}
+}
+
+func (d *discoverer) shutdown() { close(d.stop) }
+
+func (d *discoverer) watch(index int, source discovery.Source) {
+	source.Watch(
+		d.stop,
+		func(forwards []*config.Forward) {
+			log.Printf(
+				"%s => %d servers found by %s",
+				d.name, len(forwards), source,
+			)
+			// The update is made holding the lock so that the lists
+			// combined by two sources are applied in order.
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			d.found[index] = forwards
+			d.update(d.combine())
+		},
+		func(err error) {
+			log.Printf(
+				"%s => Discovery by %s failed, keeping the last servers: %s",
+				d.name, source, err,
+			)
+		},
+	)
+}
+
+// combine returns the static forwards followed by the ones found by the
+// sources, if an address is repeated only its first forward is kept.
+func (d *discoverer) combine() []*config.Forward {
+	seen := make(map[string]bool)
+	forwards := make([]*config.Forward, 0, len(d.static))
+	for _, list := range append([][]*config.Forward{d.static}, d.found...) {
+		for _, forward := range list {
+			if !seen[forward.Addr] {
+				seen[forward.Addr] = true
+				forwards = append(forwards, forward)
+			}
+		}
+	}
+	return forwards
+}
+
+func newDiscoverer(
+	name string,
+	static []*config.Forward,
+	sources []discovery.Source,
+	update func([]*config.Forward),
+) *discoverer {
+	return &discoverer{
+		name:    name,
+		sources: sources,
+		static:  static,
+		found:   make([][]*config.Forward, len(sources)),
+		update:  update,
+		stop:    make(chan struct{}),
+	}
+}
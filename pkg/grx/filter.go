@@ -0,0 +1,140 @@
+package grx
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/MAD-py/grx/pkg/config"
+	"github.com/MAD-py/grx/pkg/errors"
+)
+
+// signatures are the patterns of the known attacks, they are matched
+// against the decoded path and query of the requests.
+var signatures = map[string][]*regexp.Regexp{
+	"path_traversal": {
+		regexp.MustCompile(`(?:^|[/\\])\.\.(?:[/\\]|$)`),
+		regexp.MustCompile(`(?i)%2e%2e|%252e|%c0%ae|\.\.%2f|\.\.%5c`),
+	},
+	"sql_injection": {
+		regexp.MustCompile(`(?i)\bunion\b(?:\s|/\*.*?\*/)+(?:all\s+)?select\b`),
+		regexp.MustCompile(`(?i)['"]\s*(?:or|and)\s+['"]?\w+['"]?\s*(?:=|like)\s*['"]?\w+`),
+		regexp.MustCompile(`(?i)\bor\s+1\s*=\s*1\b`),
+		regexp.MustCompile(`(?i);\s*(?:drop|delete|insert|update|alter|truncate)\s`),
+		regexp.MustCompile(`(?i)\b(?:sleep|benchmark|pg_sleep)\s*\(`),
+		regexp.MustCompile(`(?i)['"]\s*(?:--|#|/\*)`),
+	},
+}
+
+// filter blocks the requests that break its rules, or only logs them in
+// detect only mode.
+type filter struct {
+	name string
+
+	config *config.Filter
+
+	// Allowed methods, empty if all of them are allowed.
+	methods map[string]struct{}
+
+	// Value of the Allow header of the 405 responses.
+	allow string
+}
+
+// check returns the error for the client if the request breaks a rule,
+// the rules are checked from the cheapest to the most expensive.
+func (f *filter) check(req *http.Request, conn net.Conn) *errors.ProxyError {
+	if _, ok := f.methods[req.Method]; len(f.methods) > 0 && !ok {
+		if f.block(conn, "method", req.Method) {
+			return errors.MethodNotAllowed().WithHeader("Allow", f.allow)
+		}
+	}
+
+	if f.config.MaxURLLength > 0 && len(req.RequestURI) > f.config.MaxURLLength {
+		if f.block(conn, "max_url_length", req.RequestURI) {
+			return errors.URITooLong()
+		}
+	}
+
+	path := req.URL.Path
+	query, err := url.QueryUnescape(req.URL.RawQuery)
+	if err != nil {
+		query = req.URL.RawQuery
+	}
+
+	for _, rule := range []struct {
+		name     string
+		patterns []*regexp.Regexp
+		value    string
+	}{
+		{"path", f.config.Path, path},
+		{"query", f.config.Query, query},
+		{"user_agent", f.config.UserAgent, req.UserAgent()},
+	} {
+		if match(rule.patterns, rule.value) && f.block(conn, rule.name, rule.value) {
+			return errors.Forbidden()
+		}
+	}
+
+	for header, patterns := range f.config.Headers {
+		for _, value := range req.Header.Values(header) {
+			if match(patterns, value) && f.block(conn, "header "+header, value) {
+				return errors.Forbidden()
+			}
+		}
+	}
+
+	for _, signature := range f.config.Signatures {
+		for _, value := range []string{req.URL.EscapedPath(), path, req.URL.RawQuery, query} {
+			if match(signatures[signature], value) && f.block(conn, signature, value) {
+				return errors.Forbidden()
+			}
+		}
+	}
+	return nil
+}
+
+// block logs the broken rule and reports if the request must be blocked.
+func (f *filter) block(conn net.Conn, rule, value string) bool {
+	if len(value) > 256 {
+		value = value[:256] + "..."
+	}
+	if f.config.DetectOnly {
+		log.Printf(
+			"%s => Filter rule %s matched %q [%s], detect only",
+			f.name, rule, value, conn.RemoteAddr().String(),
+		)
+		return false
+	}
+	log.Printf(
+		"%s => Request blocked by filter rule %s %q [%s]",
+		f.name, rule, value, conn.RemoteAddr().String(),
+	)
+	return true
+}
+
+// match reports if any of the patterns matches the value.
+func match(patterns []*regexp.Regexp, value string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func newFilter(name string, config *config.Filter) *filter {
+	methods := make(map[string]struct{}, len(config.Methods))
+	for _, method := range config.Methods {
+		methods[method] = struct{}{}
+	}
+
+	return &filter{
+		name:    name,
+		config:  config,
+		methods: methods,
+		allow:   strings.Join(config.Methods, ", "),
+	}
+}
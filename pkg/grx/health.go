@@ -0,0 +1,163 @@
+package grx
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MAD-py/grx/pkg/config"
+	"github.com/MAD-py/grx/pkg/lb"
+)
+
+// Maximum amount of the body read to look for the expected substring.
+const maxHealthCheckBody = 64 << 10 // INFO: 64 KB
+
+type healthChecker struct {
+	// Name of the server that will be visible in the logs
+	name string
+
+	config *config.HealthCheck
+
+	// HTTP client used for the HTTP checks.
+	client *http.Client
+
+	mu sync.Mutex
+
+	// Channels closed to stop the checks of each server.
+	stops map[*lb.Backend]chan struct{}
+}
+
+// run starts checking each server in the background.
+func (h *healthChecker) run(backends []*lb.Backend) {
+	for _, backend := range backends {
+		h.add(backend)
+	}
+}
+
+// add starts checking a server in the background.
+func (h *healthChecker) add(backend *lb.Backend) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.stops[backend]; ok {
+		return
+	}
+	stop := make(chan struct{})
+	h.stops[backend] = stop
+	go h.watch(backend, stop)
+}
+
+// remove stops checking a server.
+func (h *healthChecker) remove(backend *lb.Backend) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if stop, ok := h.stops[backend]; ok {
+		close(stop)
+		delete(h.stops, backend)
+	}
+}
+
+func (h *healthChecker) shutdown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for backend, stop := range h.stops {
+		close(stop)
+		delete(h.stops, backend)
+	}
+}
+
+// watch checks the server periodically and changes its health
+// after the configured number of consecutive results.
+func (h *healthChecker) watch(backend *lb.Backend, stop chan struct{}) {
+	ticker := time.NewTicker(h.config.Interval)
+	defer ticker.Stop()
+
+	var successes, failures int
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := h.check(backend.Addr)
+		if err == nil {
+			successes++
+			failures = 0
+		} else {
+			failures++
+			successes = 0
+		}
+
+		if successes == h.config.Rise && backend.SetHealthy(true) {
+			log.Printf("%s => Server %s is healthy", h.name, backend.Addr)
+		}
+		if failures == h.config.Fall && backend.SetHealthy(false) {
+			log.Printf("%s => Server %s is unhealthy: %s", h.name, backend.Addr, err)
+		}
+	}
+}
+
+func (h *healthChecker) check(addr string) error {
+	if h.config.TCP {
+		conn, err := net.DialTimeout("tcp", addr, h.config.Timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	res, err := h.client.Get(fmt.Sprintf("http://%s%s", addr, h.config.Path))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if !h.expectedStatus(res.StatusCode) {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	if h.config.Body != "" {
+		body, err := io.ReadAll(io.LimitReader(res.Body, maxHealthCheckBody))
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(string(body), h.config.Body) {
+			return fmt.Errorf("body does not contain %q", h.config.Body)
+		}
+	}
+	return nil
+}
+
+func (h *healthChecker) expectedStatus(code int) bool {
+	if len(h.config.Status) == 0 {
+		return code >= 200 && code < 400
+	}
+	for _, status := range h.config.Status {
+		if status == code {
+			return true
+		}
+	}
+	return false
+}
+
+func newHealthChecker(name string, config *config.HealthCheck) *healthChecker {
+	return &healthChecker{
+		name:   name,
+		config: config,
+		client: &http.Client{
+			Timeout: config.Timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		stops: make(map[*lb.Backend]chan struct{}),
+	}
+}
@@ -0,0 +1,474 @@
+package grx
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MAD-py/grx/pkg/config"
+	"github.com/MAD-py/grx/pkg/errors"
+)
+
+const (
+	// jwksMinRefresh is the minimum time between two reads of the keys,
+	// so that the tokens with unknown keys do not flood the JWKS server.
+	jwksMinRefresh = 10 * time.Second
+
+	// jwksTimeout limits the time spent fetching the keys from the URL.
+	jwksTimeout = 10 * time.Second
+
+	// maxJWKSSize limits the size of the keys read from the URL.
+	maxJWKSSize = 1 << 20 // INFO: 1 MB
+)
+
+// jwtValidator validates the bearer tokens of the requests. The keys are
+// read again in the background once the refresh time has passed or when
+// a token is signed with an unknown key.
+type jwtValidator struct {
+	name string
+
+	config *config.JWT
+
+	client *http.Client
+
+	mu sync.RWMutex
+
+	// Keys of the JWKS, the ones without id are kept with an empty id.
+	keys []*jsonWebKey
+
+	// Last read of the keys and if there is one in progress.
+	fetched    time.Time
+	refreshing bool
+}
+
+// jsonWebKey is a key of the JWKS ready to verify signatures.
+type jsonWebKey struct {
+	id string
+
+	// Algorithm the key must be used with, empty if any of its type.
+	alg string
+
+	// *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey or []byte.
+	key any
+}
+
+// jwtError is the reason why a token is not valid.
+type jwtError string
+
+func (e jwtError) Error() string { return string(e) }
+
+// authenticate validates the token of the request and copies the
+// configured claims to its headers.
+func (v *jwtValidator) authenticate(req *http.Request) *errors.ProxyError {
+	// The claim headers can only come from a valid token.
+	for header := range v.config.Headers {
+		req.Header.Del(header)
+	}
+
+	scheme, token, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return errors.Unauthorized().WithHeader(
+			"WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s"`, v.config.Realm),
+		)
+	}
+
+	claims, err := v.validate(strings.TrimSpace(token))
+	if err != nil {
+		log.Printf("%s => Invalid bearer token: %s", v.name, err)
+		return errors.Unauthorized().WithHeader("WWW-Authenticate", fmt.Sprintf(
+			`Bearer realm="%s", error="invalid_token", error_description="%s"`,
+			v.config.Realm, err,
+		))
+	}
+
+	for header, claim := range v.config.Headers {
+		if value, ok := claimValue(claims[claim]); ok {
+			req.Header.Set(header, value)
+		}
+	}
+	return nil
+}
+
+// validate verifies the signature of the token and checks its claims.
+func (v *jwtValidator) validate(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, jwtError("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, jwtError("malformed header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, jwtError("malformed signature")
+	}
+
+	keys := v.lookup(header.Kid)
+	if len(keys) == 0 {
+		return nil, jwtError("unknown key")
+	}
+	input := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range keys {
+		if key.alg != "" && key.alg != header.Alg {
+			continue
+		}
+		if verified = verifySignature(header.Alg, key.key, input, signature); verified {
+			break
+		}
+	}
+	if !verified {
+		return nil, jwtError("invalid signature")
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil || claims == nil {
+		return nil, jwtError("malformed claims")
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// checkClaims checks the time, issuer, audience and required claims.
+func (v *jwtValidator) checkClaims(claims map[string]any) error {
+	now := time.Now()
+	skew := v.config.ClockSkew
+	exp, ok := numericDate(claims["exp"])
+	if !ok && v.config.RequireExp {
+		return jwtError("missing expiration")
+	}
+	if ok && now.After(exp.Add(skew)) {
+		return jwtError("token expired")
+	}
+	if nbf, ok := numericDate(claims["nbf"]); ok && now.Add(skew).Before(nbf) {
+		return jwtError("token not valid yet")
+	}
+	if iat, ok := numericDate(claims["iat"]); ok && now.Add(skew).Before(iat) {
+		return jwtError("token issued in the future")
+	}
+
+	if v.config.Issuer != "" && claims["iss"] != v.config.Issuer {
+		return jwtError("invalid issuer")
+	}
+
+	if len(v.config.Audience) > 0 {
+		var audience []any
+		switch aud := claims["aud"].(type) {
+		case string:
+			audience = []any{aud}
+		case []any:
+			audience = aud
+		}
+		if !containsAny(audience, v.config.Audience) {
+			return jwtError("invalid audience")
+		}
+	}
+
+	for _, claim := range v.config.RequiredClaims {
+		if claims[claim] == nil {
+			return jwtError(fmt.Sprintf("missing claim %s", claim))
+		}
+	}
+	return nil
+}
+
+// lookup returns the keys that can have signed a token with the key id,
+// refreshing them if they are old or the key is unknown.
+func (v *jwtValidator) lookup(kid string) []*jsonWebKey {
+	v.mu.RLock()
+	var keys []*jsonWebKey
+	for _, key := range v.keys {
+		if kid == "" || key.id == kid {
+			keys = append(keys, key)
+		}
+	}
+	age := time.Since(v.fetched)
+	v.mu.RUnlock()
+
+	if age >= v.config.Refresh || (len(keys) == 0 && age >= jwksMinRefresh) {
+		v.refresh()
+	}
+	return keys
+}
+
+// refresh reads the keys in the background unless a read is already in
+// progress.
+func (v *jwtValidator) refresh() {
+	v.mu.Lock()
+	if v.refreshing {
+		v.mu.Unlock()
+		return
+	}
+	v.refreshing = true
+	v.mu.Unlock()
+
+	go func() {
+		keys, err := v.fetch()
+
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		v.refreshing = false
+		v.fetched = time.Now()
+		if err != nil {
+			log.Printf("%s => JWKS could not be read, keeping the last keys: %s", v.name, err)
+			return
+		}
+		v.keys = keys
+	}()
+}
+
+// fetch reads the keys from the file or the URL of the JWKS.
+func (v *jwtValidator) fetch() ([]*jsonWebKey, error) {
+	if v.config.JWKSFile != "" {
+		data, err := os.ReadFile(v.config.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		return parseJWKS(data)
+	}
+
+	res, err := v.client.Get(v.config.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxJWKSSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
+
+// parseJWKS reads the keys of a JWKS, the keys of unsupported types or
+// used for encryption are ignored.
+func parseJWKS(data []byte) ([]*jsonWebKey, error) {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make([]*jsonWebKey, 0, len(jwks.Keys))
+	for i, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		var key any
+		var err error
+		switch {
+		case jwk.Kty == "RSA":
+			key, err = rsaKey(jwk.N, jwk.E)
+		case jwk.Kty == "EC" && jwk.Crv == "P-256":
+			key, err = ecdsaKey(jwk.X, jwk.Y)
+		case jwk.Kty == "OKP" && jwk.Crv == "Ed25519":
+			key, err = ed25519Key(jwk.X)
+		case jwk.Kty == "oct":
+			key, err = base64.RawURLEncoding.DecodeString(jwk.K)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %d is not valid: %w", i, err)
+		}
+		keys = append(keys, &jsonWebKey{id: jwk.Kid, alg: jwk.Alg, key: key})
+	}
+	return keys, nil
+}
+
+func rsaKey(n, e string) (*rsa.PublicKey, error) {
+	modulus, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, err
+	}
+	exponent, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, err
+	}
+	if len(exponent) == 0 || len(exponent) > 4 {
+		return nil, fmt.Errorf("invalid exponent")
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(modulus),
+		E: int(new(big.Int).SetBytes(exponent).Int64()),
+	}, nil
+}
+
+func ecdsaKey(x, y string) (*ecdsa.PublicKey, error) {
+	xBytes, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+	yBytes, err := base64.RawURLEncoding.DecodeString(y)
+	if err != nil {
+		return nil, err
+	}
+	key := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(xBytes),
+		Y:     new(big.Int).SetBytes(yBytes),
+	}
+	if !key.Curve.IsOnCurve(key.X, key.Y) {
+		return nil, fmt.Errorf("point not on curve")
+	}
+	return key, nil
+}
+
+func ed25519Key(x string) (ed25519.PublicKey, error) {
+	key, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid size")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// verifySignature verifies the signature with the key if its type matches
+// the algorithm.
+func verifySignature(alg string, key any, input, signature []byte) bool {
+	hash := sha256.Sum256(input)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256" &&
+			rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) == nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(key, hash[:], r, s)
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(key, input, signature)
+	case []byte:
+		if alg != "HS256" {
+			return false
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write(input)
+		return hmac.Equal(mac.Sum(nil), signature)
+	}
+	return false
+}
+
+// decodeSegment decodes a base64url JSON segment of the token.
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// numericDate returns the time of a date claim, false if it is missing.
+func numericDate(value any) (time.Time, bool) {
+	number, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// claimValue formats a claim as a header value, the lists are separated
+// by commas and the objects are kept as JSON.
+func claimValue(value any) (string, bool) {
+	switch value := value.(type) {
+	case nil:
+		return "", false
+	case string:
+		return value, true
+	case json.Number:
+		return value.String(), true
+	case bool:
+		return fmt.Sprint(value), true
+	case []any:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			if item, ok := claimValue(item); ok {
+				values = append(values, item)
+			}
+		}
+		return strings.Join(values, ","), true
+	}
+	data, err := json.Marshal(value)
+	return string(data), err == nil
+}
+
+// containsAny reports if any of the values is one of the wanted strings.
+func containsAny(values []any, wanted []string) bool {
+	for _, value := range values {
+		for _, w := range wanted {
+			if value == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func newJWTValidator(name string, config *config.JWT) (*jwtValidator, error) {
+	validator := &jwtValidator{
+		name:   name,
+		config: config,
+		client: &http.Client{Timeout: jwksTimeout},
+	}
+
+	keys, err := validator.fetch()
+	if err != nil {
+		if config.JWKSFile != "" {
+			return nil, fmt.Errorf("JWKS of %s: %w", name, err)
+		}
+		// The JWKS server may not be up yet, the keys are read again
+		// with the first requests.
+		log.Printf("%s => JWKS could not be read: %s", name, err)
+	}
+	validator.keys = keys
+	validator.fetched = time.Now()
+	return validator, nil
+}
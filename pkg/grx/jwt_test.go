@@ -0,0 +1,392 @@
+package grx
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MAD-py/grx/pkg/config"
+)
+
+// jwksServer is a stand-in JWKS server whose keys can be changed.
+type jwksServer struct {
+	mu sync.Mutex
+
+	keys []map[string]string
+
+	// Times the keys were requested.
+	requests int
+}
+
+func (s *jwksServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	json.NewEncoder(w).Encode(map[string]any{"keys": s.keys})
+}
+
+func (s *jwksServer) add(key map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append(s.keys, key)
+}
+
+func (s *jwksServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// signingKeys are the private keys of the tests and their JWKs.
+type signingKeys struct {
+	rsa     *rsa.PrivateKey
+	ecdsa   *ecdsa.PrivateKey
+	ed25519 ed25519.PrivateKey
+	secret  []byte
+}
+
+func newSigningKeys(t *testing.T) *signingKeys {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &signingKeys{
+		rsa:     rsaKey,
+		ecdsa:   ecdsaKey,
+		ed25519: ed25519Key,
+		secret:  []byte("a secret of at least thirty-two bytes"),
+	}
+}
+
+func b64(data []byte) string { return base64.RawURLEncoding.EncodeToString(data) }
+
+func (k *signingKeys) jwks() []map[string]string {
+	return []map[string]string{
+		{
+			"kty": "RSA", "kid": "rsa", "use": "sig",
+			"n": b64(k.rsa.N.Bytes()),
+			"e": b64(big.NewInt(int64(k.rsa.E)).Bytes()),
+		},
+		{
+			"kty": "EC", "kid": "ec", "crv": "P-256",
+			"x": b64(k.ecdsa.X.FillBytes(make([]byte, 32))),
+			"y": b64(k.ecdsa.Y.FillBytes(make([]byte, 32))),
+		},
+		{
+			"kty": "OKP", "kid": "ed", "crv": "Ed25519",
+			"x": b64(k.ed25519.Public().(ed25519.PublicKey)),
+		},
+		{"kty": "oct", "kid": "hs", "alg": "HS256", "k": b64(k.secret)},
+	}
+}
+
+// sign creates a token with the algorithm, signing it with the key of the
+// algorithm unless the signature is given.
+func (k *signingKeys) sign(
+	t *testing.T, alg, kid string, claims map[string]any, signature []byte,
+) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := b64(header) + "." + b64(payload)
+	if signature != nil {
+		return input + "." + b64(signature)
+	}
+
+	hash := sha256.Sum256([]byte(input))
+	var err error
+	switch alg {
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, hash[:])
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k.ecdsa, hash[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case "EdDSA":
+		signature = ed25519.Sign(k.ed25519, []byte(input))
+	case "HS256":
+		signature = hmacSHA256(k.secret, input)
+	default:
+		t.Fatalf("unsupported algorithm %s", alg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + b64(signature)
+}
+
+func hmacSHA256(key []byte, input string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(input))
+	return mac.Sum(nil)
+}
+
+func newTestJWTValidator(t *testing.T, keys []map[string]string, jwt config.JWT) (*jwtValidator, *jwksServer) {
+	t.Helper()
+
+	jwks := &jwksServer{keys: keys}
+	server := httptest.NewServer(jwks)
+	t.Cleanup(server.Close)
+
+	jwt.JWKSURL = server.URL
+	if jwt.Refresh == 0 {
+		jwt.Refresh = time.Hour
+	}
+	validator, err := newJWTValidator("test", &jwt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return validator, jwks
+}
+
+func validClaims() map[string]any {
+	return map[string]any{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}
+}
+
+func TestJWTAlgorithms(t *testing.T) {
+	keys := newSigningKeys(t)
+	validator, _ := newTestJWTValidator(t, keys.jwks(), config.JWT{RequireExp: true})
+
+	for _, test := range []struct{ alg, kid string }{
+		{"RS256", "rsa"},
+		{"ES256", "ec"},
+		{"EdDSA", "ed"},
+		{"HS256", "hs"},
+		// Without key id all the keys are tried.
+		{"ES256", ""},
+	} {
+		token := keys.sign(t, test.alg, test.kid, validClaims(), nil)
+		claims, err := validator.validate(token)
+		if err != nil {
+			t.Errorf("%s token with key %q: %s", test.alg, test.kid, err)
+			continue
+		}
+		if claims["sub"] != "alice" {
+			t.Errorf("%s token: sub = %v, want alice", test.alg, claims["sub"])
+		}
+	}
+}
+
+func TestJWTRejectsNone(t *testing.T) {
+	keys := newSigningKeys(t)
+	validator, _ := newTestJWTValidator(t, keys.jwks(), config.JWT{RequireExp: true})
+
+	for _, kid := range []string{"", "rsa", "hs"} {
+		token := keys.sign(t, "none", kid, validClaims(), []byte{})
+		if _, err := validator.validate(token); err == nil {
+			t.Errorf("unsigned token with key %q was accepted", kid)
+		}
+	}
+}
+
+func TestJWTRejectsAlgorithmConfusion(t *testing.T) {
+	keys := newSigningKeys(t)
+	validator, _ := newTestJWTValidator(t, keys.jwks(), config.JWT{RequireExp: true})
+
+	rsaPublic := keys.rsa.N.Bytes()
+	for name, token := range map[string]string{
+		"RS256 with the EC key":  relabel(keys.sign(t, "ES256", "ec", validClaims(), nil), "RS256"),
+		"EdDSA with the HS key":  relabel(keys.sign(t, "HS256", "hs", validClaims(), nil), "EdDSA"),
+		"ES256 with the RSA key": relabel(keys.sign(t, "RS256", "rsa", validClaims(), nil), "ES256"),
+	} {
+		if _, err := validator.validate(token); err == nil {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+
+	// The HMAC of the real input with the public RSA key, the attack
+	// against the libraries that use the key for any algorithm.
+	input := strings.Join(strings.Split(keys.sign(t, "HS256", "rsa", validClaims(), []byte{}), ".")[:2], ".")
+	token := input + "." + b64(hmacSHA256(rsaPublic, input))
+	if _, err := validator.validate(token); err == nil {
+		t.Error("HS256 token signed with the public RSA key was accepted")
+	}
+}
+
+// relabel changes the algorithm of the header of the token keeping its
+// signature.
+func relabel(token, alg string) string {
+	parts := strings.Split(token, ".")
+	data, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	var header map[string]string
+	json.Unmarshal(data, &header)
+	header["alg"] = alg
+	data, _ = json.Marshal(header)
+	parts[0] = b64(data)
+	return strings.Join(parts, ".")
+}
+
+func TestJWTUnknownKeyRefetchesJWKS(t *testing.T) {
+	keys := newSigningKeys(t)
+	jwks := keys.jwks()
+	validator, server := newTestJWTValidator(t, jwks[:1], config.JWT{RequireExp: true})
+
+	server.add(jwks[2])
+	token := keys.sign(t, "EdDSA", "ed", validClaims(), nil)
+
+	// The keys were just read, a new read is not allowed yet.
+	if _, err := validator.validate(token); err == nil {
+		t.Fatal("token with an unknown key was accepted")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := server.count(); got != 1 {
+		t.Fatalf("JWKS read %d times before the minimum refresh time, want 1", got)
+	}
+
+	validator.mu.Lock()
+	validator.fetched = time.Now().Add(-jwksMinRefresh)
+	validator.mu.Unlock()
+	if _, err := validator.validate(token); err == nil {
+		t.Fatal("token with an unknown key was accepted before reading the keys")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := validator.validate(token)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("token still rejected after reading the keys again: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := server.count(); got != 2 {
+		t.Errorf("JWKS read %d times, want 2", got)
+	}
+}
+
+func TestJWTClaims(t *testing.T) {
+	keys := newSigningKeys(t)
+	now := time.Now()
+
+	for _, test := range []struct {
+		name   string
+		jwt    config.JWT
+		claims map[string]any
+		valid  bool
+	}{
+		{
+			name:   "expired within the clock skew",
+			jwt:    config.JWT{RequireExp: true, ClockSkew: time.Minute},
+			claims: map[string]any{"exp": now.Add(-30 * time.Second).Unix()},
+			valid:  true,
+		},
+		{
+			name:   "expired beyond the clock skew",
+			jwt:    config.JWT{RequireExp: true, ClockSkew: time.Minute},
+			claims: map[string]any{"exp": now.Add(-2 * time.Minute).Unix()},
+		},
+		{
+			name:   "not valid yet within the clock skew",
+			jwt:    config.JWT{RequireExp: true, ClockSkew: time.Minute},
+			claims: map[string]any{"exp": now.Add(time.Hour).Unix(), "nbf": now.Add(30 * time.Second).Unix()},
+			valid:  true,
+		},
+		{
+			name:   "not valid yet beyond the clock skew",
+			jwt:    config.JWT{RequireExp: true, ClockSkew: time.Minute},
+			claims: map[string]any{"exp": now.Add(time.Hour).Unix(), "nbf": now.Add(2 * time.Minute).Unix()},
+		},
+		{
+			name:   "issued in the future",
+			jwt:    config.JWT{RequireExp: true},
+			claims: map[string]any{"exp": now.Add(time.Hour).Unix(), "iat": now.Add(time.Minute).Unix()},
+		},
+		{
+			name:   "without expiration",
+			jwt:    config.JWT{RequireExp: true},
+			claims: map[string]any{"sub": "alice"},
+		},
+		{
+			name:   "without expiration allowed",
+			jwt:    config.JWT{},
+			claims: map[string]any{"sub": "alice"},
+			valid:  true,
+		},
+		{
+			name:   "invalid expiration",
+			jwt:    config.JWT{RequireExp: true},
+			claims: map[string]any{"exp": "tomorrow"},
+		},
+		{
+			name:   "expected issuer",
+			jwt:    config.JWT{RequireExp: true, Issuer: "https://auth.test"},
+			claims: map[string]any{"exp": now.Add(time.Hour).Unix(), "iss": "https://auth.test"},
+			valid:  true,
+		},
+		{
+			name:   "other issuer",
+			jwt:    config.JWT{RequireExp: true, Issuer: "https://auth.test"},
+			claims: map[string]any{"exp": now.Add(time.Hour).Unix(), "iss": "https://evil.test"},
+		},
+		{
+			name:   "without issuer",
+			jwt:    config.JWT{RequireExp: true, Issuer: "https://auth.test"},
+			claims: map[string]any{"exp": now.Add(time.Hour).Unix()},
+		},
+		{
+			name:   "audience in a list",
+			jwt:    config.JWT{RequireExp: true, Audience: []string{"api", "web"}},
+			claims: map[string]any{"exp": now.Add(time.Hour).Unix(), "aud": []string{"other", "web"}},
+			valid:  true,
+		},
+		{
+			name:   "audience as a string",
+			jwt:    config.JWT{RequireExp: true, Audience: []string{"api"}},
+			claims: map[string]any{"exp": now.Add(time.Hour).Unix(), "aud": "api"},
+			valid:  true,
+		},
+		{
+			name:   "other audience",
+			jwt:    config.JWT{RequireExp: true, Audience: []string{"api"}},
+			claims: map[string]any{"exp": now.Add(time.Hour).Unix(), "aud": []string{"web"}},
+		},
+		{
+			name:   "without audience",
+			jwt:    config.JWT{RequireExp: true, Audience: []string{"api"}},
+			claims: map[string]any{"exp": now.Add(time.Hour).Unix()},
+		},
+		{
+			name:   "missing required claim",
+			jwt:    config.JWT{RequireExp: true, RequiredClaims: []string{"sub"}},
+			claims: map[string]any{"exp": now.Add(time.Hour).Unix()},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			validator, _ := newTestJWTValidator(t, keys.jwks(), test.jwt)
+			_, err := validator.validate(keys.sign(t, "RS256", "rsa", test.claims, nil))
+			if test.valid && err != nil {
+				t.Errorf("token rejected: %s", err)
+			}
+			if !test.valid && err == nil {
+				t.Error("token accepted")
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package grx
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/MAD-py/grx/pkg/config"
+	"github.com/MAD-py/grx/pkg/lb"
+
+	proxyHTTP "github.com/MAD-py/grx/pkg/http"
+)
+
+// maxMirrorInflight limits the mirrored requests waiting for a response,
+// the copies are dropped when the shadow servers can not keep up.
+const maxMirrorInflight = 128
+
+// mirrorReportInterval is the time between the logs of the counters of
+// the mirrored requests.
+const mirrorReportInterval = time.Minute
+
+// mirror sends copies of the requests to the shadow servers in the
+// background, the responses are discarded.
+type mirror struct {
+	// Name of the server that will be visible in the logs.
+	name string
+
+	// Proxy id and type of headers, the same as the ones of the server.
+	id           string
+	useForwarded bool
+
+	config *config.Mirror
+
+	// HTTP client used only for the mirrored requests.
+	client *http.Client
+
+	// Load balancer of the shadow servers.
+	loadBalancer lb.LoadBalancer
+
+	// Semaphore of the mirrored requests in progress.
+	inflight chan struct{}
+
+	// Counters of the mirrored requests.
+	succeeded atomic.Uint64
+	failed    atomic.Uint64
+	dropped   atomic.Uint64
+
+	// Closed to stop the reports of the counters.
+	stop chan struct{}
+}
+
+// mirror sends a copy of the request if it is part of the sampled
+// percentage. The body is read up to the limit and restored, so the
+// original request is not affected.
+func (m *mirror) mirror(req *http.Request, conn *net.TCPConn) {
+	if rand.Float64()*100 >= m.config.Percent {
+		return
+	}
+
+	if req.ContentLength > m.config.MaxBodySize {
+		m.dropped.Add(1)
+		return
+	}
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(req.Body, m.config.MaxBodySize+1))
+		req.Body = &multiReadCloser{
+			Reader: io.MultiReader(bytes.NewReader(body), req.Body),
+			Closer: req.Body,
+		}
+		if err != nil || int64(len(body)) > m.config.MaxBodySize {
+			m.dropped.Add(1)
+			return
+		}
+	}
+
+	select {
+	case m.inflight <- struct{}{}:
+	default:
+		m.dropped.Add(1)
+		return
+	}
+
+	shadow := req.Clone(context.Background())
+	shadow.Body = io.NopCloser(bytes.NewReader(body))
+	shadow.ContentLength = int64(len(body))
+	shadow.TransferEncoding = nil
+	localAddr, remoteAddr := conn.LocalAddr().String(), conn.RemoteAddr().String()
+
+	go func() {
+		defer func() { <-m.inflight }()
+
+		backend := m.loadBalancer.GetServer()
+		if backend == nil {
+			m.failed.Add(1)
+			return
+		}
+
+		forwarded := proxyHTTP.NewProxyRquest(
+			shadow, m.id, backend.Addr, localAddr, remoteAddr,
+		).IntoForwarded(m.useForwarded)
+
+		res, err := m.client.Do(forwarded)
+		if err != nil {
+			m.failed.Add(1)
+			return
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+
+		if res.StatusCode >= http.StatusInternalServerError {
+			m.failed.Add(1)
+		} else {
+			m.succeeded.Add(1)
+		}
+	}()
+}
+
+// run logs the counters periodically in the background while they change.
+func (m *mirror) run() {
+	go func() {
+		ticker := time.NewTicker(mirrorReportInterval)
+		defer ticker.Stop()
+
+		var last [3]uint64
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+			}
+
+			counters := m.counters()
+			if counters != last {
+				m.report(counters)
+				last = counters
+			}
+		}
+	}()
+}
+
+func (m *mirror) shutdown() {
+	close(m.stop)
+	m.report(m.counters())
+}
+
+// counters returns the mirrored requests succeeded, failed and dropped.
+func (m *mirror) counters() [3]uint64 {
+	return [3]uint64{m.succeeded.Load(), m.failed.Load(), m.dropped.Load()}
+}
+
+func (m *mirror) report(counters [3]uint64) {
+	log.Printf(
+		"%s => Mirrored requests: %d succeeded, %d failed, %d dropped",
+		m.name, counters[0], counters[1], counters[2],
+	)
+}
+
+// multiReadCloser reads from a reader and closes the original body.
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func newMirror(configServer *config.ForwardServer) *mirror {
+	return &mirror{
+		name:         configServer.Name,
+		id:           configServer.ID,
+		useForwarded: configServer.UseForwarded,
+		config:       configServer.Mirror,
+		client:       &http.Client{Timeout: configServer.Mirror.Timeout},
+		loadBalancer: lb.NewRoundRobin(configServer.Mirror.Forward),
+		inflight:     make(chan struct{}, maxMirrorInflight),
+		stop:         make(chan struct{}),
+	}
+}
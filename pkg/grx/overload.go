@@ -0,0 +1,143 @@
+package grx
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/MAD-py/grx/pkg/config"
+	"github.com/MAD-py/grx/pkg/errors"
+
+	proxyHTTP "github.com/MAD-py/grx/pkg/http"
+)
+
+// rejectWriteTimeout limits the time spent sending the response to a
+// rejected connection.
+const rejectWriteTimeout = time.Second
+
+// accept takes a slot of the connections semaphore and processes the
+// connection, when all the slots are taken the overload policy is applied.
+// The connections of the denied clients do not take any slot.
+func (s *baseServer) accept(conn *net.TCPConn, forward func(*net.TCPConn)) {
+	if s.accessList != nil && !s.accessList.allowed(remoteIP(conn)) {
+		s.deny(conn)
+		return
+	}
+
+	select {
+	case s.connections <- struct{}{}:
+		s.serve(conn, forward)
+		return
+	default:
+	}
+
+	switch s.overload.Policy {
+	case config.OverloadWait:
+		if s.overload.Timeout == 0 {
+			s.connections <- struct{}{}
+			s.serve(conn, forward)
+			return
+		}
+
+		// The waiting connections are bounded, as each one holds its
+		// socket until it gets a slot or the timeout expires.
+		select {
+		case s.waiting <- struct{}{}:
+		default:
+			go s.reject(conn)
+			return
+		}
+
+		go func() {
+			defer func() { <-s.waiting }()
+			timer := time.NewTimer(s.overload.Timeout)
+			defer timer.Stop()
+			select {
+			case s.connections <- struct{}{}:
+				s.serve(conn, forward)
+			case <-timer.C:
+				s.reject(conn)
+			}
+		}()
+	case config.OverloadReject:
+		go s.reject(conn)
+	case config.OverloadClose:
+		s.rejected.Add(1)
+		log.Printf(
+			"%s => Connection closed [%s], server overloaded (%d rejected)",
+			s.name, conn.RemoteAddr().String(), s.rejected.Load(),
+		)
+		conn.Close()
+	}
+}
+
+// serve processes a connection that has taken a slot of the semaphore,
+// unless its client has too many connections.
+func (s *baseServer) serve(conn *net.TCPConn, forward func(*net.TCPConn)) {
+	if s.clientLimiter == nil {
+		log.Printf(
+			"%s => Accept new connection [%s]",
+			s.name, conn.RemoteAddr().String(),
+		)
+		go forward(conn)
+		return
+	}
+
+	addr := remoteIP(conn)
+	if !s.clientLimiter.acquireConnection(addr) {
+		<-s.connections
+		log.Printf("%s => Too many connections from %s", s.name, addr)
+		go s.refuse(conn, errors.TooManyRequests())
+		return
+	}
+
+	log.Printf(
+		"%s => Accept new connection [%s]",
+		s.name, conn.RemoteAddr().String(),
+	)
+	go func() {
+		defer s.clientLimiter.releaseConnection(addr)
+		forward(conn)
+	}()
+}
+
+// deny closes the connection of a client denied by the access list,
+// responding with a 403 unless the server drops them.
+func (s *baseServer) deny(conn *net.TCPConn) {
+	log.Printf(
+		"%s => Access denied [%s]",
+		s.name, conn.RemoteAddr().String(),
+	)
+	if s.dropDenied {
+		conn.Close()
+		return
+	}
+	go s.refuse(conn, errors.Forbidden())
+}
+
+// reject responds to the connection with a 503 and closes it.
+func (s *baseServer) reject(conn *net.TCPConn) {
+	s.rejected.Add(1)
+	log.Printf(
+		"%s => Connection rejected [%s], server overloaded (%d rejected)",
+		s.name, conn.RemoteAddr().String(), s.rejected.Load(),
+	)
+
+	err := errors.ServiceUnavailable()
+	if s.overload.RetryAfter > 0 {
+		err.WithHeader("Retry-After", seconds(s.overload.RetryAfter))
+	}
+	s.refuse(conn, err)
+}
+
+// refuse responds to a connection that is not processed and closes it,
+// the write timeout of the clients is only used if it is shorter.
+func (s *baseServer) refuse(conn *net.TCPConn, err *errors.ProxyError) {
+	defer conn.Close()
+	timeout := rejectWriteTimeout
+	if s.clientLimits.WriteTimeout > 0 && s.clientLimits.WriteTimeout < timeout {
+		timeout = s.clientLimits.WriteTimeout
+	}
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	write(conn, proxyHTTP.ErrorToResponse(nil, err))
+}
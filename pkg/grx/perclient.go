@@ -0,0 +1,154 @@
+package grx
+
+import (
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/MAD-py/grx/pkg/config"
+	"github.com/MAD-py/grx/pkg/errors"
+)
+
+// clientLimiter limits the simultaneous connections and requests of each
+// client IP and of each network prefix.
+type clientLimiter struct {
+	config *config.PerClient
+
+	connections *concurrency
+
+	requests *concurrency
+}
+
+// allowed reports if the client is not limited.
+func (l *clientLimiter) allowed(addr netip.Addr) bool {
+	for _, prefix := range l.config.Allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// prefix returns the network of the client.
+func (l *clientLimiter) prefix(addr netip.Addr) netip.Prefix {
+	bits := l.config.IPv6Prefix
+	if addr.Is4() {
+		bits = l.config.IPv4Prefix
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix
+}
+
+// acquireConnection reserves a connection of the client, false if the
+// client or its network have reached their limit.
+func (l *clientLimiter) acquireConnection(addr netip.Addr) bool {
+	return l.allowed(addr) || l.connections.acquire(addr, l.prefix(addr))
+}
+
+func (l *clientLimiter) releaseConnection(addr netip.Addr) {
+	if !l.allowed(addr) {
+		l.connections.release(addr, l.prefix(addr))
+	}
+}
+
+// acquireRequest reserves a request of the client, false if the client
+// or its network have reached their limit.
+func (l *clientLimiter) acquireRequest(addr netip.Addr) bool {
+	return l.allowed(addr) || l.requests.acquire(addr, l.prefix(addr))
+}
+
+func (l *clientLimiter) releaseRequest(addr netip.Addr) {
+	if !l.allowed(addr) {
+		l.requests.release(addr, l.prefix(addr))
+	}
+}
+
+// concurrency counts what is in progress for each IP and prefix, only the
+// ones with something in progress are kept.
+type concurrency struct {
+	// Limits per IP and prefix, 0 if there is no limit.
+	perIP     int
+	perPrefix int
+
+	mu       sync.Mutex
+	ips      map[netip.Addr]int
+	prefixes map[netip.Prefix]int
+}
+
+func (c *concurrency) acquire(addr netip.Addr, prefix netip.Prefix) bool {
+	if c.perIP == 0 && c.perPrefix == 0 {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.perIP > 0 && c.ips[addr] >= c.perIP {
+		return false
+	}
+	if c.perPrefix > 0 && c.prefixes[prefix] >= c.perPrefix {
+		return false
+	}
+	c.ips[addr]++
+	c.prefixes[prefix]++
+	return true
+}
+
+func (c *concurrency) release(addr netip.Addr, prefix netip.Prefix) {
+	if c.perIP == 0 && c.perPrefix == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ips[addr]--; c.ips[addr] <= 0 {
+		delete(c.ips, addr)
+	}
+	if c.prefixes[prefix]--; c.prefixes[prefix] <= 0 {
+		delete(c.prefixes, prefix)
+	}
+}
+
+// limitRequest reserves a request of the client of the connection, the
+// returned function must be called once the request is finished.
+func (s *baseServer) limitRequest(conn net.Conn) (func(), *errors.ProxyError) {
+	if s.clientLimiter == nil {
+		return func() {}, nil
+	}
+
+	addr := remoteIP(conn)
+	if !s.clientLimiter.acquireRequest(addr) {
+		log.Printf("%s => Too many requests from %s", s.name, addr)
+		return func() {}, errors.TooManyRequests()
+	}
+	return func() { s.clientLimiter.releaseRequest(addr) }, nil
+}
+
+// remoteIP returns the IP of the client of the connection.
+func remoteIP(conn net.Conn) netip.Addr {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		ip, _ := netip.AddrFromSlice(addr.IP)
+		return ip.Unmap()
+	}
+	return netip.Addr{}
+}
+
+func newClientLimiter(config *config.PerClient) *clientLimiter {
+	return &clientLimiter{
+		config: config,
+		connections: &concurrency{
+			perIP:     config.Connections,
+			perPrefix: config.PrefixConnections,
+			ips:       make(map[netip.Addr]int),
+			prefixes:  make(map[netip.Prefix]int),
+		},
+		requests: &concurrency{
+			perIP:     config.Requests,
+			perPrefix: config.PrefixRequests,
+			ips:       make(map[netip.Addr]int),
+			prefixes:  make(map[netip.Prefix]int),
+		},
+	}
+}
@@ -0,0 +1,61 @@
+package grx
+
+import (
+	"sync"
+
+	"github.com/MAD-py/grx/pkg/config"
+)
+
+// requestQueue holds the requests that wait for a server when all of
+// them have reached their limit of simultaneous requests.
+type requestQueue struct {
+	config *config.Queue
+
+	// Semaphore of the waiting requests.
+	waiting chan struct{}
+
+	mu sync.Mutex
+
+	// Closed when a server finishes a request, so that the waiting
+	// requests try again.
+	released chan struct{}
+}
+
+// enter reserves a place in the queue, false if the queue is full.
+func (q *requestQueue) enter() bool {
+	select {
+	case q.waiting <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (q *requestQueue) leave() { <-q.waiting }
+
+// wait returns the channel closed on the next release.
+func (q *requestQueue) wait() <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.released
+}
+
+// release wakes up the waiting requests.
+func (q *requestQueue) release() {
+	if len(q.waiting) == 0 {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	close(q.released)
+	q.released = make(chan struct{})
+}
+
+func newRequestQueue(config *config.Queue) *requestQueue {
+	return &requestQueue{
+		config:   config,
+		waiting:  make(chan struct{}, config.Size),
+		released: make(chan struct{}),
+	}
+}
@@ -0,0 +1,212 @@
+package grx
+
+import (
+	"container/list"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/MAD-py/grx/pkg/config"
+	"github.com/MAD-py/grx/pkg/errors"
+)
+
+// rateLimiter limits the requests of each key with a token bucket or a
+// sliding window. The keys are kept in a LRU list so that the memory
+// used is bounded.
+type rateLimiter struct {
+	config *config.RateLimit
+
+	mu sync.Mutex
+
+	// State of each key, the elements of the LRU list.
+	keys map[string]*list.Element
+
+	// Keys ordered from the most to the least recently used.
+	lru *list.List
+}
+
+// rateLimitState is the token bucket or the sliding window of a key.
+type rateLimitState struct {
+	key string
+
+	// Token bucket.
+	tokens float64
+	last   time.Time
+
+	// Sliding window, the requests of the current and previous windows.
+	windowStart time.Time
+	current     int
+	previous    int
+}
+
+// limit consumes a request of the client, if the limit is reached the
+// request waits up to the configured delay before being rejected. The
+// headers describing the limit are returned to be added to the response.
+func (l *rateLimiter) limit(req *http.Request, conn net.Conn) (http.Header, *errors.ProxyError) {
+	key := l.key(req, conn)
+	deadline := time.Now().Add(l.config.Delay)
+	for {
+		now := time.Now()
+		ok, remaining, reset, wait := l.take(key, now)
+		if ok {
+			return l.header(remaining, reset), nil
+		}
+
+		if now.Add(wait).After(deadline) {
+			err := errors.TooManyRequests()
+			for name, values := range l.header(remaining, reset) {
+				err.WithHeader(name, values[0])
+			}
+			return nil, err.WithHeader("Retry-After", seconds(wait))
+		}
+		time.Sleep(wait)
+	}
+}
+
+// key returns the key of the request.
+func (l *rateLimiter) key(req *http.Request, conn net.Conn) string {
+	if l.config.KeyServer {
+		return ""
+	}
+	if l.config.KeyHeader != "" {
+		if value := req.Header.Get(l.config.KeyHeader); value != "" {
+			return "header:" + value
+		}
+	}
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	return "ip:" + host
+}
+
+// take consumes a request of the key. It returns the requests that remain,
+// the time until the limit is fully restored and, if the request is not
+// allowed, the time until it would be.
+func (l *rateLimiter) take(
+	key string, now time.Time,
+) (ok bool, remaining int, reset, wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	state := l.state(key, now)
+	if l.config.SlidingWindow {
+		return l.slidingWindow(state, now)
+	}
+	return l.tokenBucket(state, now)
+}
+
+func (l *rateLimiter) tokenBucket(
+	state *rateLimitState, now time.Time,
+) (bool, int, time.Duration, time.Duration) {
+	perToken := l.config.Period / time.Duration(l.config.Rate)
+	burst := float64(l.config.Burst)
+
+	state.tokens += float64(now.Sub(state.last)) / float64(perToken)
+	if state.tokens > burst {
+		state.tokens = burst
+	}
+	state.last = now
+
+	ok := state.tokens >= 1
+	if ok {
+		state.tokens--
+	}
+
+	reset := time.Duration((burst - state.tokens) * float64(perToken))
+	if ok {
+		return true, int(state.tokens), reset, 0
+	}
+	return false, 0, reset, time.Duration((1 - state.tokens) * float64(perToken))
+}
+
+func (l *rateLimiter) slidingWindow(
+	state *rateLimitState, now time.Time,
+) (bool, int, time.Duration, time.Duration) {
+	period := l.config.Period
+	start := now.Truncate(period)
+	if !start.Equal(state.windowStart) {
+		if start.Sub(state.windowStart) == period {
+			state.previous = state.current
+		} else {
+			state.previous = 0
+		}
+		state.current = 0
+		state.windowStart = start
+	}
+
+	// The requests of the previous window are weighted by the part of
+	// it that is still inside the sliding window.
+	elapsed := now.Sub(start)
+	weight := 1 - float64(elapsed)/float64(period)
+	estimated := float64(state.previous)*weight + float64(state.current)
+	reset := period - elapsed
+
+	rate := float64(l.config.Rate)
+	if estimated+1 <= rate {
+		state.current++
+		return true, int(rate - estimated - 1), reset, 0
+	}
+
+	if state.current+1 > l.config.Rate || state.previous == 0 {
+		return false, 0, reset, reset
+	}
+	// Time until the weight of the previous window leaves room for one request.
+	allowed := (rate - float64(state.current) - 1) / float64(state.previous)
+	wait := time.Duration((1-allowed)*float64(period)) - elapsed
+	if wait <= 0 {
+		wait = time.Millisecond
+	}
+	return false, 0, reset, wait
+}
+
+// state returns the state of the key, creating it if it does not exist
+// and forgetting the least recently used key if there are too many.
+func (l *rateLimiter) state(key string, now time.Time) *rateLimitState {
+	if element, ok := l.keys[key]; ok {
+		l.lru.MoveToFront(element)
+		return element.Value.(*rateLimitState)
+	}
+
+	state := &rateLimitState{
+		key:         key,
+		tokens:      float64(l.config.Burst),
+		last:        now,
+		windowStart: now.Truncate(l.config.Period),
+	}
+	l.keys[key] = l.lru.PushFront(state)
+
+	if l.lru.Len() > l.config.MaxKeys {
+		oldest := l.lru.Back()
+		l.lru.Remove(oldest)
+		delete(l.keys, oldest.Value.(*rateLimitState).key)
+	}
+	return state
+}
+
+// header returns the RateLimit headers of the response.
+func (l *rateLimiter) header(remaining int, reset time.Duration) http.Header {
+	limit := l.config.Burst
+	if l.config.SlidingWindow {
+		limit = l.config.Rate
+	}
+
+	header := http.Header{}
+	header.Set("RateLimit-Limit", strconv.Itoa(limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	header.Set("RateLimit-Reset", seconds(reset))
+	return header
+}
+
+// seconds formats a duration as a whole number of seconds, rounded up.
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+func newRateLimiter(config *config.RateLimit) *rateLimiter {
+	return &rateLimiter{
+		config: config,
+		keys:   make(map[string]*list.Element),
+		lru:    list.New(),
+	}
+}
@@ -0,0 +1,123 @@
+package grx
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/MAD-py/grx/pkg/config"
+)
+
+type retryPolicy struct {
+	config *config.Retry
+
+	// Limits the retries to avoid retry storms.
+	budget *retryBudget
+}
+
+// attempts returns the number of attempts allowed for the request.
+func (p *retryPolicy) attempts(req *http.Request) int {
+	if p == nil {
+		return 1
+	}
+	if !p.config.NonIdempotent && !idempotent(req.Method) {
+		return 1
+	}
+	return p.config.Attempts
+}
+
+// retryable reports if the result of an attempt can be retried.
+func (p *retryPolicy) retryable(res *http.Response, err error) bool {
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok && urlErr.Timeout() {
+			return p.config.OnTimeout
+		}
+		return p.config.OnConnectError
+	}
+
+	for _, status := range p.config.Status {
+		if status == res.StatusCode {
+			return true
+		}
+	}
+	return false
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions,
+		http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retryBudget is a token bucket, each request deposits a fraction of a
+// token and each retry withdraws a whole token, so the retries can not
+// exceed a percentage of the requests plus a minimum per second.
+type retryBudget struct {
+	mu sync.Mutex
+
+	// Tokens deposited by each request.
+	ratio float64
+
+	// Tokens deposited each second.
+	minPerSecond float64
+
+	// Maximum tokens that can be accumulated.
+	maxTokens float64
+
+	tokens float64
+
+	// Last time the tokens per second were deposited.
+	last time.Time
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	b.tokens += b.ratio
+	if b.tokens > b.maxTokens {
+		b.tokens = b.maxTokens
+	}
+}
+
+// withdraw reports if there are enough tokens for a retry.
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *retryBudget) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.minPerSecond
+	if b.tokens > b.maxTokens {
+		b.tokens = b.maxTokens
+	}
+	b.last = now
+}
+
+func newRetryPolicy(config *config.Retry) *retryPolicy {
+	ratio := float64(config.Budget) / 100
+	minPerSecond := float64(config.MinRetries)
+	return &retryPolicy{
+		config: config,
+		budget: &retryBudget{
+			ratio:        ratio,
+			minPerSecond: minPerSecond,
+			maxTokens:    minPerSecond + ratio*100,
+			tokens:       minPerSecond,
+			last:         time.Now(),
+		},
+	}
+}
@@ -1,15 +1,18 @@
 package grx
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/MAD-py/grx/pkg/config"
@@ -42,6 +45,47 @@ type baseServer struct {
 	// Connections are limited and this channel is used as a Semaphore
 	// to prevent overloading.
 	connections chan struct{}
+
+	// Limit of requests per client, nil if the server does not use it.
+	rateLimiter *rateLimiter
+
+	// Deadlines and limits of the client connections.
+	clientLimits config.ClientLimits
+
+	// How the connections over the limit are handled.
+	overload config.Overload
+
+	// Slots of the connections waiting up to the overload timeout.
+	waiting chan struct{}
+
+	// Connections rejected because the server was overloaded.
+	rejected *atomic.Uint64
+
+	// Limits of each client, nil if the server does not use them.
+	clientLimiter *clientLimiter
+
+	// Clients allowed to connect, nil if all of them are allowed.
+	accessList *accessList
+
+	// Closes the connections of the denied clients without a response.
+	dropDenied bool
+
+	// Users allowed to send requests, nil if the server does not use it.
+	basicAuth *basicAuth
+
+	// Validation of the bearer tokens, nil if the server does not use it.
+	jwtValidator *jwtValidator
+
+	// External authorization of the requests, nil if the server does not
+	// use it.
+	authRequest *authRequest
+
+	// Rules that block the requests, nil if the server does not use them.
+	filter *filter
+
+	// Cross-origin requests allowed, nil if the server does not handle
+	// them.
+	cors *cors
 }
 
 func (s *baseServer) getStatus() serverStatus { return s.status }
@@ -54,6 +98,9 @@ func (s *baseServer) shutdown() {
 	s.listener.Close()
 	s.status = shuttingDown
 	log.Printf("%s => Listening is closed", s.name)
+	if rejected := s.rejected.Load(); rejected > 0 {
+		log.Printf("%s => %d connections rejected by overload", s.name, rejected)
+	}
 	log.Printf(
 		"%s => %d connections waiting to be closed",
 		s.name, len(s.connections),
@@ -83,8 +130,55 @@ type forwardServer struct {
 	// HTTP client in charge of processing incoming requests.
 	client *http.Client
 
-	// Load balancer for forwarding.
-	loadBalancer lb.LoadBalancer
+	// Upstreams between which the requests are split.
+	splitter *splitter
+
+	// Retries of the failed requests, nil if the server does not use them.
+	retry *retryPolicy
+
+	// Copies of the requests to a shadow upstream, nil if the server
+	// does not use it.
+	mirror *mirror
+
+	// Maximum size of the request bodies, 0 if there is no limit.
+	maxBodySize int64
+
+	// Storage of the request bodies read before forwarding them, nil
+	// if the bodies are streamed.
+	spool *config.Spool
+
+	// Responses stored in memory, nil if the server does not cache them.
+	cache *responseCache
+}
+
+// bodyError returns the error used when the request body can not be read.
+func (s *forwardServer) bodyError(err error) *errors.ProxyError {
+	if cause, ok := clientFailure(err); ok {
+		err = cause
+	}
+	if bodyTooLarge(err) {
+		return errors.ContentTooLarge()
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return errors.RequestTimeout()
+	}
+	if _, ok := err.(*os.PathError); ok {
+		log.Printf("%s => Request body could not be stored: %s", s.name, err)
+		return errors.InternalServerError()
+	}
+	return errors.BadRequest()
+}
+
+func (s *forwardServer) shutdown() {
+	if s.status == online {
+		for _, u := range s.splitter.upstreams {
+			u.shutdown()
+		}
+	}
+	s.baseServer.shutdown()
+	if s.mirror != nil {
+		s.mirror.shutdown()
+	}
 }
 
 func (s *forwardServer) forward(conn *net.TCPConn) {
@@ -97,47 +191,250 @@ func (s *forwardServer) forward(conn *net.TCPConn) {
 		<-s.connections
 	}()
 
-	b := bytes.Buffer{}
-	req, err := http.ReadRequest(bufio.NewReaderSize(conn, maxRequestSize))
-	if err != nil {
-		res := proxyHTTP.ErrorToResponse(nil, errors.BadRequest())
-		res.IntoForwarded().Write(&b)
-		conn.Write(b.Bytes())
-		res.CloseBody()
+	req, proxyErr := s.readRequest(conn)
+	if proxyErr != nil {
+		s.writeResponse(conn, proxyHTTP.ErrorToResponse(req, proxyErr))
+		return
+	}
+	if req == nil {
+		return
+	}
+
+	release, proxyErr := s.limitRequest(conn)
+	defer release()
+	if proxyErr != nil {
+		s.writeResponse(conn, proxyHTTP.ErrorToResponse(req, proxyErr))
+		return
+	}
+
+	var rateLimitHeader http.Header
+	if s.rateLimiter != nil {
+		rateLimitHeader, proxyErr = s.rateLimiter.limit(req, conn)
+		if proxyErr != nil {
+			s.writeResponse(conn, proxyHTTP.ErrorToResponse(req, proxyErr))
+			return
+		}
+	}
+
+	if s.cors != nil {
+		if response, ok := s.cors.preflight(req); ok {
+			s.writeResponse(conn, response)
+			return
+		}
+	}
+
+	if s.filter != nil {
+		if proxyErr := s.filter.check(req, conn); proxyErr != nil {
+			s.writeResponse(conn, proxyHTTP.ErrorToResponse(req, proxyErr))
+			return
+		}
+	}
+
+	// The responses of the authenticated requests are cached like the ones
+	// with Authorization, which is decided before the authentication as it
+	// may remove the header or add the ones of the user.
+	authenticated := s.basicAuth != nil || s.jwtValidator != nil || s.authRequest != nil
+
+	if s.basicAuth != nil {
+		if proxyErr := s.basicAuth.authenticate(req, conn); proxyErr != nil {
+			s.writeResponse(conn, proxyHTTP.ErrorToResponse(req, proxyErr))
+			return
+		}
+	}
+
+	if s.jwtValidator != nil {
+		if proxyErr := s.jwtValidator.authenticate(req); proxyErr != nil {
+			s.writeResponse(conn, proxyHTTP.ErrorToResponse(req, proxyErr))
+			return
+		}
+	}
+
+	if s.authRequest != nil {
+		if response := s.authRequest.authorize(req, conn); response != nil {
+			s.writeResponse(conn, response)
+			return
+		}
+	}
+
+	if s.maxBodySize > 0 {
+		if req.ContentLength > s.maxBodySize {
+			s.writeResponse(conn, proxyHTTP.ErrorToResponse(req, errors.ContentTooLarge()))
+			return
+		}
+		limitBody(req, s.maxBodySize)
+	}
+
+	if s.spool != nil {
+		remove, err := spoolBody(req, s.spool)
+		defer remove()
+		if err != nil {
+			s.writeResponse(conn, proxyHTTP.ErrorToResponse(req, s.bodyError(err)))
+			return
+		}
+	}
+
+	if s.mirror != nil {
+		s.mirror.mirror(req, conn)
+	}
+
+	u := s.splitter.choose(req, conn)
+	var backend *lb.Backend
+	var res *http.Response
+	if s.cache != nil {
+		// The backend is nil if the response comes from the cache.
+		fetch := func(req *http.Request) (*http.Response, *errors.ProxyError) {
+			var res *http.Response
+			var proxyErr *errors.ProxyError
+			backend, res, proxyErr = s.roundTrip(u, req, conn)
+			return res, proxyErr
+		}
+		res, proxyErr = s.cache.roundTrip(req, u.name, authenticated, fetch)
+	} else {
+		backend, res, proxyErr = s.roundTrip(u, req, conn)
+	}
+	if proxyErr != nil {
+		s.writeResponse(conn, proxyHTTP.ErrorToResponse(req, proxyErr))
 		return
 	}
 
+	response := proxyHTTP.NewProxyResponse(res)
+	addHeader(response.Header(), rateLimitHeader)
+	if s.cors != nil {
+		s.cors.apply(req, response.Header())
+	}
+	if u.sticky != nil && backend != nil && !u.sticky.attached(req, backend) {
+		response.Header().Add("Set-Cookie", u.sticky.cookie(backend.Addr).String())
+	}
+	s.writeResponse(conn, response)
+}
+
+// roundTrip sends the request to a server of the upstream, if it fails and
+// the retry policy allows it, the request is sent again to another server.
+func (s *forwardServer) roundTrip(
+	u *upstream, req *http.Request, conn *net.TCPConn,
+) (*lb.Backend, *http.Response, *errors.ProxyError) {
+	attempts := s.retry.attempts(req)
+	if attempts > 1 {
+		if err := bufferBody(req); err != nil {
+			return nil, nil, s.bodyError(err)
+		}
+		s.retry.budget.deposit()
+	}
+
+	tried := make([]*lb.Backend, 0, attempts)
+	// Servers whose circuit refused the request, they are avoided like the
+	// tried ones but do not count as attempts.
+	var refused []*lb.Backend
+	for {
+		backend, proxyErr := u.acquire(req, append(tried[:len(tried):len(tried)], refused...))
+		if proxyErr != nil {
+			return nil, nil, proxyErr
+		}
+		if breaker := backend.Breaker(); breaker != nil && !breaker.Allow() {
+			u.done(backend)
+			// The balancer only returns an avoided server when there is
+			// no other one.
+			if contains(refused, backend) || contains(tried, backend) {
+				return nil, nil, u.unavailable()
+			}
+			refused = append(refused, backend)
+			continue
+		}
+		tried = append(tried, backend)
+
+		res, err := s.send(u, req, conn, backend)
+		if _, ok := clientFailure(err); ok {
+			return nil, nil, s.bodyError(err)
+		}
+		if len(tried) < attempts &&
+			s.retry.retryable(res, err) &&
+			s.retry.budget.withdraw() {
+			if res != nil {
+				res.Body.Close()
+			}
+			log.Printf(
+				"%s => Retrying request [%s], server %s failed",
+				s.name, conn.RemoteAddr().String(), backend.Addr,
+			)
+			continue
+		}
+
+		if err != nil {
+			if urlErr, ok := err.(*url.Error); ok && urlErr.Timeout() {
+				return nil, nil, errors.RequestTimeout()
+			}
+			return nil, nil, errors.BadGateway()
+		}
+		return backend, res, nil
+	}
+}
+
+// send forwards the request to the server and feeds the balancer and the
+// passive health checks with the result. The server is considered busy
+// until the body of the response is closed.
+func (s *forwardServer) send(
+	u *upstream, req *http.Request, conn *net.TCPConn, backend *lb.Backend,
+) (*http.Response, error) {
+	if req.GetBody != nil {
+		req.Body, _ = req.GetBody()
+	}
+
 	request := proxyHTTP.NewProxyRquest(
 		req,
 		s.id,
-		s.loadBalancer.GetServer(),
+		backend.Addr,
 		conn.LocalAddr().String(),
 		conn.RemoteAddr().String(),
 	)
-	res, err := s.client.Do(request.IntoForwarded(s.useForwarded))
+	forwarded := request.IntoForwarded(s.useForwarded)
+
+	cancel := func() {}
+	if s.retry != nil && s.retry.config.TryTimeout > 0 {
+		var ctx context.Context
+		ctx, cancel = context.WithTimeout(forwarded.Context(), s.retry.config.TryTimeout)
+		forwarded = forwarded.WithContext(ctx)
+	}
+
+	start := time.Now()
+	res, err := s.client.Do(forwarded)
 	if err != nil {
-		var proxyErr *errors.ProxyError
-		if urlErr := err.(*url.Error); urlErr.Timeout() {
-			proxyErr = errors.RequestTimeout()
+		u.done(backend)
+		cancel()
+		if _, ok := clientFailure(err); ok {
+			// The client is the one that failed, the request says
+			// nothing about the health of the server.
+			if breaker := backend.Breaker(); breaker != nil {
+				breaker.Release()
+			}
 		} else {
-			proxyErr = errors.BadGateway()
+			u.report(backend, 0)
 		}
+		return nil, err
+	}
 
-		res := proxyHTTP.ErrorToResponse(req, proxyErr)
-		res.IntoForwarded().Write(&b)
-		conn.Write(b.Bytes())
-		res.CloseBody()
-		return
+	u.report(backend, res.StatusCode)
+	if observer, ok := u.loadBalancer.(lb.Observer); ok {
+		observer.Observe(backend, time.Since(start))
 	}
 
-	response := proxyHTTP.NewProxyResponse(res)
-	response.IntoForwarded().Write(&b)
-	conn.Write(b.Bytes())
-	response.CloseBody()
+	res.Body = &releaseBody{
+		ReadCloser: res.Body,
+		release: func() {
+			u.done(backend)
+			cancel()
+		},
+	}
+	return res, nil
 }
 
 func (s *forwardServer) run() {
 	log.Printf("Starting the forward server %s", s.name)
+	for _, u := range s.splitter.upstreams {
+		u.run()
+	}
+	if s.mirror != nil {
+		s.mirror.run()
+	}
 	log.Printf("%s => Listening for requests", s.name)
 	s.status = online
 Loop:
@@ -146,12 +443,7 @@ Loop:
 		if err != nil {
 			break Loop
 		}
-		s.connections <- struct{}{}
-		log.Printf(
-			"%s => Accept new connection [%s]",
-			s.name, conn.RemoteAddr().String(),
-		)
-		go s.forward(conn)
+		s.accept(conn, s.forward)
 	}
 }
 
@@ -172,29 +464,79 @@ func (s *staticServer) forward(conn *net.TCPConn) {
 		<-s.connections
 	}()
 
-	b := bytes.Buffer{}
-	req, err := http.ReadRequest(bufio.NewReaderSize(conn, maxRequestSize))
-	if err != nil {
-		res := proxyHTTP.ErrorToResponse(nil, errors.BadRequest())
-		res.IntoForwarded().Write(&b)
-		conn.Write(b.Bytes())
+	req, proxyErr := s.readRequest(conn)
+	if proxyErr != nil {
+		s.writeResponse(conn, proxyHTTP.ErrorToResponse(req, proxyErr))
+		return
+	}
+	if req == nil {
+		return
+	}
+
+	release, proxyErr := s.limitRequest(conn)
+	defer release()
+	if proxyErr != nil {
+		s.writeResponse(conn, proxyHTTP.ErrorToResponse(req, proxyErr))
 		return
 	}
 
+	var rateLimitHeader http.Header
+	if s.rateLimiter != nil {
+		rateLimitHeader, proxyErr = s.rateLimiter.limit(req, conn)
+		if proxyErr != nil {
+			s.writeResponse(conn, proxyHTTP.ErrorToResponse(req, proxyErr))
+			return
+		}
+	}
+
+	if s.cors != nil {
+		if response, ok := s.cors.preflight(req); ok {
+			s.writeResponse(conn, response)
+			return
+		}
+	}
+
+	if s.filter != nil {
+		if proxyErr := s.filter.check(req, conn); proxyErr != nil {
+			s.writeResponse(conn, proxyHTTP.ErrorToResponse(req, proxyErr))
+			return
+		}
+	}
+
+	if s.basicAuth != nil {
+		if proxyErr := s.basicAuth.authenticate(req, conn); proxyErr != nil {
+			s.writeResponse(conn, proxyHTTP.ErrorToResponse(req, proxyErr))
+			return
+		}
+	}
+
+	if s.jwtValidator != nil {
+		if proxyErr := s.jwtValidator.authenticate(req); proxyErr != nil {
+			s.writeResponse(conn, proxyHTTP.ErrorToResponse(req, proxyErr))
+			return
+		}
+	}
+
+	if s.authRequest != nil {
+		if response := s.authRequest.authorize(req, conn); response != nil {
+			s.writeResponse(conn, response)
+			return
+		}
+	}
+
 	path := filepath.Join(s.pathPrefix, req.URL.Path)
 	file, err := os.ReadFile(path)
 	if err != nil {
-		res := proxyHTTP.ErrorToResponse(nil, errors.NotFound())
-		res.IntoForwarded().Write(&b)
-		conn.Write(b.Bytes())
-		res.CloseBody()
+		s.writeResponse(conn, proxyHTTP.ErrorToResponse(nil, errors.NotFound()))
 		return
 	}
 
-	res := proxyHTTP.NewFileProxyResponse(req, file)
-	res.IntoForwarded().Write(&b)
-	conn.Write(b.Bytes())
-	res.CloseBody()
+	response := proxyHTTP.NewFileProxyResponse(req, file)
+	addHeader(response.Header(), rateLimitHeader)
+	if s.cors != nil {
+		s.cors.apply(req, response.Header())
+	}
+	s.writeResponse(conn, response)
 }
 
 func (s *staticServer) run() {
@@ -207,13 +549,124 @@ Loop:
 		if err != nil {
 			break Loop
 		}
-		s.connections <- struct{}{}
-		log.Printf(
-			"%s => Accept new connection [%s]",
-			s.name, conn.RemoteAddr().String(),
-		)
-		go s.forward(conn)
+		s.accept(conn, s.forward)
+	}
+}
+
+// writeResponse sends the response to the client and closes its body.
+func (s *baseServer) writeResponse(conn net.Conn, res *proxyHTTP.ProxyResponse) {
+	if s.clientLimits.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(s.clientLimits.WriteTimeout))
+	}
+	write(conn, res)
+}
+
+// write sends the response to the client with the deadline already set.
+func write(conn net.Conn, res *proxyHTTP.ProxyResponse) {
+	b := bytes.Buffer{}
+	res.IntoForwarded().Write(&b)
+	conn.Write(b.Bytes())
+	res.CloseBody()
+}
+
+// addHeader adds the headers of src to dst.
+func addHeader(dst, src http.Header) {
+	for key, values := range src {
+		for _, value := range values {
+			dst.Add(key, value)
+		}
+	}
+}
+
+// bufferBody reads the whole body of the request so that it can be
+// sent more than once, unless it can already be read again.
+func bufferBody(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	req.Body.Close()
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return nil
+}
+
+func contains(backends []*lb.Backend, backend *lb.Backend) bool {
+	for _, b := range backends {
+		if b == backend {
+			return true
+		}
 	}
+	return false
+}
+
+// releaseBody calls release once the body is closed.
+type releaseBody struct {
+	io.ReadCloser
+
+	once sync.Once
+
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+func newBaseServer(configServer *config.Server, listener *net.TCPListener) (baseServer, error) {
+	server := baseServer{
+		name:         configServer.Name,
+		status:       offline,
+		listener:     listener,
+		connections:  make(chan struct{}, configServer.MaxConnections),
+		clientLimits: configServer.Client,
+		overload:     configServer.Overload,
+		rejected:     &atomic.Uint64{},
+	}
+	if configServer.Overload.Policy == config.OverloadWait && configServer.Overload.Timeout > 0 {
+		server.waiting = make(chan struct{}, configServer.Overload.QueueSize)
+	}
+	if configServer.RateLimit != nil {
+		server.rateLimiter = newRateLimiter(configServer.RateLimit)
+	}
+	if configServer.PerClient != nil {
+		server.clientLimiter = newClientLimiter(configServer.PerClient)
+	}
+	if configServer.Access != nil {
+		server.accessList = newAccessList(configServer.Access)
+		server.dropDenied = configServer.Access.Drop
+	}
+	if configServer.BasicAuth != nil {
+		basicAuth, err := newBasicAuth(configServer.Name, configServer.BasicAuth)
+		if err != nil {
+			return server, err
+		}
+		server.basicAuth = basicAuth
+	}
+	if configServer.JWT != nil {
+		jwtValidator, err := newJWTValidator(configServer.Name, configServer.JWT)
+		if err != nil {
+			return server, err
+		}
+		server.jwtValidator = jwtValidator
+	}
+	if configServer.AuthRequest != nil {
+		server.authRequest = newAuthRequest(configServer.Name, configServer.AuthRequest)
+	}
+	if configServer.Filter != nil {
+		server.filter = newFilter(configServer.Name, configServer.Filter)
+	}
+	if configServer.CORS != nil {
+		server.cors = newCORS(configServer.CORS)
+	}
+	return server, nil
 }
 
 func newForwardServer(configServer *config.ForwardServer) (*forwardServer, error) {
@@ -227,6 +680,12 @@ func newForwardServer(configServer *config.ForwardServer) (*forwardServer, error
 		return nil, err
 	}
 
+	base, err := newBaseServer(&configServer.Server, listener)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
 	transport := http.Transport{
 		Dial: (&net.Dialer{
 			Timeout:   30 * time.Second,
@@ -240,28 +699,49 @@ func newForwardServer(configServer *config.ForwardServer) (*forwardServer, error
 		Timeout:   configServer.TimeoutPerRequest * time.Second,
 	}
 
-	var loadBalancer lb.LoadBalancer
-	switch configServer.LoadBalancer {
-	case config.Base:
-		loadBalancer = lb.NewBase(configServer.Forward[0])
-	case config.RoundRobin:
-		loadBalancer = lb.NewRoundRobin(configServer.Forward)
-	case config.WeightedRoundRobin:
-		loadBalancer = lb.NewWeightedRoundRobin(configServer.Forward)
+	// Without groups the forwards of the server are its only upstream.
+	groups := configServer.Groups
+	if groups == nil {
+		groups = []*config.Group{{
+			LoadBalancer: configServer.LoadBalancer,
+			Forward:      configServer.Forward,
+			Resolver:     configServer.Resolver,
+			Discovery:    configServer.Discovery,
+			Weight:       1,
+		}}
 	}
 
-	return &forwardServer{
-		baseServer: baseServer{
-			name:        configServer.Name,
-			status:      offline,
-			listener:    listener,
-			connections: make(chan struct{}, configServer.MaxConnections),
-		},
+	upstreams := make([]*upstream, len(groups))
+	for i, group := range groups {
+		name := configServer.Name
+		if group.Name != "" {
+			name = fmt.Sprintf("%s/%s", configServer.Name, group.Name)
+		}
+		upstreams[i] = newUpstream(name, group, configServer)
+	}
+
+	var retry *retryPolicy
+	if configServer.Retry != nil {
+		retry = newRetryPolicy(configServer.Retry)
+	}
+
+	server := &forwardServer{
+		baseServer:   base,
 		id:           configServer.ID,
 		client:       client,
-		loadBalancer: loadBalancer,
+		splitter:     newSplitter(upstreams, configServer.Split),
+		retry:        retry,
 		useForwarded: configServer.UseForwarded,
-	}, nil
+		maxBodySize:  configServer.MaxBodySize,
+		spool:        configServer.Spool,
+	}
+	if configServer.Mirror != nil {
+		server.mirror = newMirror(configServer)
+	}
+	if configServer.Cache != nil {
+		server.cache = newResponseCache(configServer.Cache)
+	}
+	return server, nil
 }
 
 func newStaticServer(config *config.StaticServer) (*staticServer, error) {
@@ -279,13 +759,14 @@ func newStaticServer(config *config.StaticServer) (*staticServer, error) {
 		return nil, err
 	}
 
+	base, err := newBaseServer(&config.Server, listener)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
 	return &staticServer{
-		baseServer: baseServer{
-			name:        config.Name,
-			status:      offline,
-			listener:    listener,
-			connections: make(chan struct{}, config.MaxConnections),
-		},
+		baseServer: base,
 		pathPrefix: config.PathPrefix,
 	}, nil
 }
@@ -0,0 +1,62 @@
+package grx
+
+import (
+	"crypto/rand"
+	"net/http"
+
+	"github.com/MAD-py/grx/pkg/config"
+	"github.com/MAD-py/grx/pkg/lb"
+)
+
+type stickySession struct {
+	// Balancer used to translate the cookie into a server.
+	loadBalancer *lb.Sticky
+
+	// Attributes of the cookie sent to the client.
+	config *config.Sticky
+}
+
+// getServer returns the server to which the client is attached, if the
+// request does not have the cookie or the server no longer exists it
+// returns false.
+func (s *stickySession) getServer(req *http.Request) (*lb.Backend, bool) {
+	cookie, err := req.Cookie(s.config.CookieName)
+	if err != nil {
+		return nil, false
+	}
+	return s.loadBalancer.GetStickyServer(cookie.Value)
+}
+
+// attached reports if the request already has the cookie of the server.
+func (s *stickySession) attached(req *http.Request, backend *lb.Backend) bool {
+	cookie, err := req.Cookie(s.config.CookieName)
+	return err == nil && cookie.Value == s.loadBalancer.Key(backend.Addr)
+}
+
+// cookie creates the cookie that attaches the client to the server.
+func (s *stickySession) cookie(addr string) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     s.config.CookieName,
+		Value:    s.loadBalancer.Key(addr),
+		Path:     s.config.Path,
+		Secure:   s.config.Secure,
+		HttpOnly: s.config.HttpOnly,
+		SameSite: s.config.SameSite,
+	}
+	if s.config.TTL > 0 {
+		cookie.MaxAge = int(s.config.TTL.Seconds())
+	}
+	return cookie
+}
+
+func newStickySession(loadBalancer lb.LoadBalancer, config *config.Sticky) *stickySession {
+	secret := []byte(config.Secret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		rand.Read(secret)
+	}
+	return &stickySession{
+		loadBalancer: lb.NewSticky(loadBalancer, secret),
+		config:       config,
+	}
+}
@@ -0,0 +1,433 @@
+package grx
+
+import (
+	"hash/fnv"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/MAD-py/grx/pkg/config"
+	"github.com/MAD-py/grx/pkg/discovery"
+	"github.com/MAD-py/grx/pkg/errors"
+	"github.com/MAD-py/grx/pkg/lb"
+)
+
+// upstream is a group of servers with its own balancer, a forward server
+// has one upstream or one for each of its groups.
+type upstream struct {
+	// Name of the upstream that will be visible in the logs.
+	name string
+
+	// Load balancer for forwarding.
+	loadBalancer lb.LoadBalancer
+
+	// Session affinity, nil if the server does not use it.
+	sticky *stickySession
+
+	// Active health checks, nil if the server does not use them.
+	healthChecker *healthChecker
+
+	// Passive health checks, nil if the server does not use them.
+	outlierDetector *lb.OutlierDetector
+
+	// Circuit breaker of each server, nil if the server does not use them.
+	circuitBreaker *config.CircuitBreaker
+
+	// Dynamic discovery of servers, nil if the server does not use it.
+	discoverer *discoverer
+
+	// Share of the traffic received by the upstream.
+	weight int
+
+	// Requests that are always sent to the upstream, nil if there are none.
+	match *config.Match
+
+	// Limit of simultaneous requests of the servers without their own.
+	maxConns int
+
+	// Requests waiting for a busy server, nil if they are rejected.
+	queue *requestQueue
+}
+
+// setServers replaces the servers of the balancer, the new servers are
+// prepared in the same way as the initial ones.
+func (u *upstream) setServers(forwards []*config.Forward) {
+	added, removed := u.loadBalancer.Update(u.limit(forwards))
+	for _, backend := range added {
+		if u.circuitBreaker != nil {
+			backend.SetBreaker(lb.NewCircuitBreaker(u.circuitBreaker))
+		}
+		if u.healthChecker != nil {
+			u.healthChecker.add(backend)
+		}
+		log.Printf("%s => Server %s added", u.name, backend.Addr)
+	}
+
+	for _, backend := range removed {
+		if u.healthChecker != nil {
+			u.healthChecker.remove(backend)
+		}
+		if u.outlierDetector != nil {
+			u.outlierDetector.Remove(backend)
+		}
+		log.Printf("%s => Server %s removed", u.name, backend.Addr)
+	}
+	if u.sticky != nil {
+		u.sticky.loadBalancer.Forget(removed)
+	}
+}
+
+// report feeds the passive health checks and the circuit breaker with the
+// result of a request, statusCode is 0 if the server could not give a response.
+func (u *upstream) report(backend *lb.Backend, statusCode int) {
+	if breaker := backend.Breaker(); breaker != nil {
+		failed := statusCode == 0 || breaker.Failed(statusCode)
+		if state, changed := breaker.Record(failed); changed {
+			log.Printf(
+				"%s => Circuit of server %s is %s",
+				u.name, backend.Addr, state,
+			)
+		}
+	}
+
+	if u.outlierDetector == nil {
+		return
+	}
+
+	if statusCode != 0 && !u.outlierDetector.Failed(statusCode) {
+		u.outlierDetector.Success(backend)
+		return
+	}
+
+	if duration, ok := u.outlierDetector.Failure(backend); ok {
+		log.Printf(
+			"%s => Server %s ejected for %s",
+			u.name, backend.Addr, duration,
+		)
+	}
+}
+
+// unavailable returns the error used when no server can process the
+// request, if there are open circuits the client is told when to retry.
+func (u *upstream) unavailable() *errors.ProxyError {
+	var retryAfter time.Duration
+	for _, backend := range u.loadBalancer.Servers() {
+		if breaker := backend.Breaker(); breaker != nil {
+			d := breaker.RetryAfter()
+			if d > 0 && (retryAfter == 0 || d < retryAfter) {
+				retryAfter = d
+			}
+		}
+	}
+
+	err := errors.ServiceUnavailable()
+	if retryAfter > 0 {
+		seconds := int(math.Ceil(retryAfter.Seconds()))
+		err.WithHeader("Retry-After", strconv.Itoa(seconds))
+	}
+	return err
+}
+
+// getServer selects the server that will process the request, avoiding
+// the servers already tried whenever possible.
+func (u *upstream) getServer(req *http.Request, tried []*lb.Backend) *lb.Backend {
+	if u.sticky != nil && len(tried) == 0 {
+		if backend, ok := u.sticky.getServer(req); ok {
+			return backend
+		}
+	}
+
+	backend := u.loadBalancer.GetServer()
+	for range u.loadBalancer.Servers() {
+		if backend == nil || !contains(tried, backend) {
+			break
+		}
+		backend = u.loadBalancer.GetServer()
+	}
+	return backend
+}
+
+// acquire selects a server and starts the request on it. When all the
+// servers are busy the request waits in the queue until one of them
+// finishes a request or the queue timeout expires.
+func (u *upstream) acquire(
+	req *http.Request, tried []*lb.Backend,
+) (*lb.Backend, *errors.ProxyError) {
+	var timeout <-chan time.Time
+	for {
+		var released <-chan struct{}
+		if u.queue != nil {
+			released = u.queue.wait()
+		}
+
+		backend := u.getServer(req, tried)
+		if backend != nil && backend.Acquire() {
+			return backend, nil
+		}
+		if u.queue == nil || (backend == nil && !u.busy()) {
+			return nil, u.unavailable()
+		}
+
+		if timeout == nil {
+			if !u.queue.enter() {
+				log.Printf("%s => Queue is full", u.name)
+				return nil, errors.ServiceUnavailable()
+			}
+			defer u.queue.leave()
+
+			timer := time.NewTimer(u.queue.config.Timeout)
+			defer timer.Stop()
+			timeout = timer.C
+			continue
+		}
+
+		select {
+		case <-released:
+		case <-timeout:
+			log.Printf("%s => Request timed out in the queue", u.name)
+			return nil, errors.ServiceUnavailable()
+		}
+	}
+}
+
+// done must be called when the server finishes a request started by acquire.
+func (u *upstream) done(backend *lb.Backend) {
+	backend.Done()
+	if u.queue != nil {
+		u.queue.release()
+	}
+}
+
+// busy reports if any server is healthy but has reached its limit.
+func (u *upstream) busy() bool {
+	for _, backend := range u.loadBalancer.Servers() {
+		if backend.Busy() {
+			return true
+		}
+	}
+	return false
+}
+
+// limit applies the limit of simultaneous requests of the upstream to the
+// forwards that do not have their own.
+func (u *upstream) limit(forwards []*config.Forward) []*config.Forward {
+	if u.maxConns == 0 {
+		return forwards
+	}
+
+	limited := make([]*config.Forward, len(forwards))
+	for i, forward := range forwards {
+		if forward.MaxConns == 0 {
+			withLimit := *forward
+			withLimit.MaxConns = u.maxConns
+			forward = &withLimit
+		}
+		limited[i] = forward
+	}
+	return limited
+}
+
+// matches reports if the headers and cookies of the request have all the
+// values required by the upstream.
+func (u *upstream) matches(req *http.Request) bool {
+	if u.match == nil {
+		return false
+	}
+
+	for name, value := range u.match.Header {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+	for name, value := range u.match.Cookie {
+		cookie, err := req.Cookie(name)
+		if err != nil || cookie.Value != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (u *upstream) run() {
+	if u.healthChecker != nil {
+		u.healthChecker.run(u.loadBalancer.Servers())
+	}
+	if u.discoverer != nil {
+		u.discoverer.run()
+	}
+}
+
+func (u *upstream) shutdown() {
+	if u.discoverer != nil {
+		u.discoverer.shutdown()
+	}
+	if u.healthChecker != nil {
+		u.healthChecker.shutdown()
+	}
+}
+
+func newUpstream(
+	name string, group *config.Group, configServer *config.ForwardServer,
+) *upstream {
+	// The dns and srv forwards are not servers but sources of servers.
+	var static []*config.Forward
+	var sources []discovery.Source
+	for _, forward := range group.Forward {
+		if forward.DNS != "" || forward.SRV != "" {
+			sources = append(sources, discovery.NewDNS(forward, group.Resolver))
+		} else {
+			static = append(static, forward)
+		}
+	}
+	if group.Discovery != nil {
+		if group.Discovery.URL != "" {
+			sources = append(sources, discovery.NewHTTP(group.Discovery))
+		} else {
+			sources = append(sources, discovery.NewFile(group.Discovery))
+		}
+	}
+
+	u := &upstream{
+		name:     name,
+		weight:   group.Weight,
+		match:    group.Match,
+		maxConns: configServer.MaxConns,
+	}
+	if configServer.Queue != nil {
+		u.queue = newRequestQueue(configServer.Queue)
+	}
+	static = u.limit(static)
+
+	var loadBalancer lb.LoadBalancer
+	switch group.LoadBalancer {
+	case config.Base:
+		loadBalancer = lb.NewBase(static[0])
+	case config.RoundRobin:
+		loadBalancer = lb.NewRoundRobin(static)
+	case config.WeightedRoundRobin:
+		loadBalancer = lb.NewWeightedRoundRobin(static)
+	case config.PowerOfTwoChoices:
+		loadBalancer = lb.NewPowerOfTwoChoices(static)
+	case config.PeakEWMA:
+		loadBalancer = lb.NewPeakEWMA(static)
+	}
+
+	u.loadBalancer = loadBalancer
+
+	if configServer.Sticky != nil {
+		u.sticky = newStickySession(loadBalancer, configServer.Sticky)
+	}
+
+	if configServer.HealthCheck != nil {
+		u.healthChecker = newHealthChecker(name, configServer.HealthCheck)
+	}
+
+	if configServer.CircuitBreaker != nil {
+		for _, backend := range loadBalancer.Servers() {
+			backend.SetBreaker(lb.NewCircuitBreaker(configServer.CircuitBreaker))
+		}
+	}
+
+	u.circuitBreaker = configServer.CircuitBreaker
+	if configServer.OutlierDetection != nil {
+		u.outlierDetector = lb.NewOutlierDetector(
+			loadBalancer, configServer.OutlierDetection,
+		)
+	}
+
+	if len(sources) > 0 {
+		u.discoverer = newDiscoverer(name, static, sources, u.setServers)
+	}
+	return u
+}
+
+// splitter chooses the upstream of each request when the traffic of a
+// server is split between several groups.
+type splitter struct {
+	upstreams []*upstream
+
+	// Sum of the weights of the upstreams.
+	totalWeight int
+
+	// Value of the request used to choose the upstream, nil to
+	// choose it randomly.
+	config *config.Split
+}
+
+// choose returns the upstream of the request. A client attached to a
+// server keeps using its upstream, then the upstreams whose match rules
+// are met are preferred, otherwise the upstream is chosen by weight.
+func (s *splitter) choose(req *http.Request, conn net.Conn) *upstream {
+	if len(s.upstreams) == 1 {
+		return s.upstreams[0]
+	}
+
+	for _, u := range s.upstreams {
+		if u.sticky == nil {
+			continue
+		}
+		if _, ok := u.sticky.getServer(req); ok {
+			return u
+		}
+	}
+
+	for _, u := range s.upstreams {
+		if u.matches(req) {
+			return u
+		}
+	}
+
+	var n int
+	if key, ok := s.key(req, conn); ok {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		n = int(h.Sum32() % uint32(s.totalWeight))
+	} else {
+		n = rand.Intn(s.totalWeight)
+	}
+
+	for _, u := range s.upstreams {
+		if n < u.weight {
+			return u
+		}
+		n -= u.weight
+	}
+	return s.upstreams[len(s.upstreams)-1]
+}
+
+// key returns the value of the request used to split the traffic, false
+// if the split is random or the request does not have the value.
+func (s *splitter) key(req *http.Request, conn net.Conn) (string, bool) {
+	switch {
+	case s.config == nil:
+		return "", false
+	case s.config.HashIP:
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		return host, err == nil
+	case s.config.HashHeader != "":
+		value := req.Header.Get(s.config.HashHeader)
+		return value, value != ""
+	default:
+		cookie, err := req.Cookie(s.config.HashCookie)
+		if err != nil || cookie.Value == "" {
+			return "", false
+		}
+		return cookie.Value, true
+	}
+}
+
+func newSplitter(upstreams []*upstream, config *config.Split) *splitter {
+	totalWeight := 0
+	for _, u := range upstreams {
+		totalWeight += u.weight
+	}
+	return &splitter{
+		upstreams:   upstreams,
+		totalWeight: totalWeight,
+		config:      config,
+	}
+}
@@ -20,6 +20,11 @@ func (r *ProxyResponse) IntoForwarded() *http.Response {
 	return r.response
 }
 
+// Header returns the headers that will be sent to the client.
+func (r *ProxyResponse) Header() http.Header {
+	return r.response.Header
+}
+
 func (r *ProxyResponse) CloseBody() {
 	r.response.Body.Close()
 }
@@ -52,6 +57,25 @@ func NewFileProxyResponse(req *http.Request, file []byte) *ProxyResponse {
 	}
 }
 
+// NewEmptyProxyResponse creates a response without body generated by the
+// proxy, using the protocol of the original request.
+func NewEmptyProxyResponse(req *http.Request, statusCode int) *ProxyResponse {
+	return &ProxyResponse{
+		response: &http.Response{
+			Status:     http.StatusText(statusCode),
+			StatusCode: statusCode,
+
+			Proto:      req.Proto,
+			ProtoMajor: req.ProtoMajor,
+			ProtoMinor: req.ProtoMinor,
+
+			Header: http.Header{},
+
+			Body: http.NoBody,
+		},
+	}
+}
+
 // ErrorToResponse transforms an internal error into a processable http response,
 // this function requires the original request from the client since it provides
 // all the information of the protocol being used in the communication.
@@ -66,6 +90,11 @@ func ErrorToResponse(req *http.Request, err *errors.ProxyError) *ProxyResponse {
 		protoMinor = req.ProtoMinor
 	}
 
+	header := http.Header{}
+	for key, values := range err.Header() {
+		header[key] = values
+	}
+
 	return &ProxyResponse{
 		response: &http.Response{
 			Status:     http.StatusText(err.StatusCode()),
@@ -75,7 +104,7 @@ func ErrorToResponse(req *http.Request, err *errors.ProxyError) *ProxyResponse {
 			ProtoMajor: protoMajor,
 			ProtoMinor: protoMinor,
 
-			Header: http.Header{},
+			Header: header,
 
 			Body:          io.NopCloser(strings.NewReader(err.Error())),
 			ContentLength: int64(len(err.Error())),
@@ -0,0 +1,186 @@
+package lb
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/MAD-py/grx/pkg/config"
+)
+
+// Backend is a server to which the requests are forwarded, it keeps the
+// state of the server that is shared by the balancers.
+type Backend struct {
+	// Address of the server.
+	Addr string
+
+	// Weight used by the weighted balancers.
+	Weight uint8
+
+	// Only used when none of the primary servers is available.
+	Backup bool
+
+	// Time during which the weight grows linearly.
+	slowStart time.Duration
+
+	// Maximum number of simultaneous requests, 0 if there is no limit.
+	maxConns int64
+
+	// Time in unix nanoseconds when the server was added or became
+	// healthy again, the slow start is counted from it.
+	since atomic.Int64
+
+	// Requests that are being processed by the server.
+	inflight atomic.Int64
+
+	// Marked by the health checks when the server does not respond.
+	down atomic.Bool
+
+	// Time in unix nanoseconds until which the server is ejected
+	// because of the failures of the requests sent to it.
+	ejectedUntil atomic.Int64
+
+	// Circuit breaker of the server, nil if it is not used.
+	breaker atomic.Pointer[CircuitBreaker]
+}
+
+// Available reports if the server can receive requests.
+func (b *Backend) Available() bool { return b.ready() && !b.Full() }
+
+// Busy reports if the server could receive requests but it has reached
+// its limit of simultaneous requests.
+func (b *Backend) Busy() bool { return b.Full() && b.ready() }
+
+// Full reports if the server has reached its limit of simultaneous requests.
+func (b *Backend) Full() bool {
+	return b.maxConns > 0 && b.inflight.Load() >= b.maxConns
+}
+
+// ready reports if the server is healthy, regardless of its load.
+func (b *Backend) ready() bool {
+	if b.down.Load() || b.Ejected() {
+		return false
+	}
+	breaker := b.breaker.Load()
+	return breaker == nil || breaker.Ready()
+}
+
+// Breaker returns the circuit breaker of the server, nil if it has none.
+func (b *Backend) Breaker() *CircuitBreaker { return b.breaker.Load() }
+
+// SetBreaker assigns a circuit breaker to the server.
+func (b *Backend) SetBreaker(breaker *CircuitBreaker) { b.breaker.Store(breaker) }
+
+// Ejected reports if the server is ejected by the outlier detection.
+func (b *Backend) Ejected() bool {
+	return time.Now().UnixNano() < b.ejectedUntil.Load()
+}
+
+// SetHealthy changes the health of the server and reports
+// if it is different from the previous one.
+func (b *Backend) SetHealthy(healthy bool) bool {
+	changed := b.down.Swap(!healthy) == healthy
+	if changed && healthy {
+		b.since.Store(time.Now().UnixNano())
+	}
+	return changed
+}
+
+// Ramp returns the fraction of its weight that the server can take,
+// it grows linearly from 0 to 1 during the slow start.
+func (b *Backend) Ramp() float64 {
+	if b.slowStart == 0 {
+		return 1
+	}
+
+	elapsed := time.Since(time.Unix(0, b.since.Load()))
+	if elapsed >= b.slowStart {
+		return 1
+	}
+	if ramp := float64(elapsed) / float64(b.slowStart); ramp > minRamp {
+		return ramp
+	}
+	return minRamp
+}
+
+// Healthy reports the health of the server according to the health checks.
+func (b *Backend) Healthy() bool { return !b.down.Load() }
+
+// Start must be called before forwarding a request to the server.
+func (b *Backend) Start() { b.inflight.Add(1) }
+
+// Acquire starts a request if the server has not reached its limit of
+// simultaneous requests, otherwise it returns false.
+func (b *Backend) Acquire() bool {
+	for {
+		inflight := b.inflight.Load()
+		if b.maxConns > 0 && inflight >= b.maxConns {
+			return false
+		}
+		if b.inflight.CompareAndSwap(inflight, inflight+1) {
+			return true
+		}
+	}
+}
+
+// Done must be called once the server has finished processing a request.
+func (b *Backend) Done() { b.inflight.Add(-1) }
+
+// Inflight returns the number of requests being processed by the server.
+func (b *Backend) Inflight() int64 { return b.inflight.Load() }
+
+// matches reports if the server was created from the forward.
+func (b *Backend) matches(forward *config.Forward) bool {
+	return b.Addr == forward.Addr &&
+		b.Weight == forward.Weight &&
+		b.Backup == forward.Backup &&
+		b.slowStart == forward.SlowStart &&
+		b.maxConns == int64(forward.MaxConns)
+}
+
+// Minimum fraction of the weight of a server in slow start, so that
+// it receives some requests from the beginning.
+const minRamp = 0.01
+
+func NewBackend(forward *config.Forward) *Backend {
+	backend := &Backend{
+		Addr:      forward.Addr,
+		Weight:    forward.Weight,
+		Backup:    forward.Backup,
+		slowStart: forward.SlowStart,
+		maxConns:  int64(forward.MaxConns),
+	}
+	backend.since.Store(time.Now().UnixNano())
+	return backend
+}
+
+func newBackends(forwards []*config.Forward) []*Backend {
+	backends := make([]*Backend, len(forwards))
+	for i, forward := range forwards {
+		backends[i] = NewBackend(forward)
+	}
+	return backends
+}
+
+// available returns the primary servers that can receive requests, or the
+// backup servers that can receive requests if there is no primary one.
+func available(servers []*Backend) []*Backend {
+	backup := useBackup(servers)
+	backends := make([]*Backend, 0, len(servers))
+	for _, server := range servers {
+		if server.Backup == backup && server.Available() {
+			backends = append(backends, server)
+		}
+	}
+	return backends
+}
+
+// useBackup reports if none of the primary servers is available, the
+// primary servers that are busy are still used.
+func useBackup(servers []*Backend) bool {
+	for _, server := range servers {
+		if !server.Backup && server.ready() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,198 @@
+package lb
+
+import (
+	"sync"
+	"time"
+
+	"github.com/MAD-py/grx/pkg/config"
+)
+
+type BreakerState uint8
+
+const (
+	Closed BreakerState = iota
+	Open
+	HalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreaker cuts off the requests to a server that is failing, after
+// some time it lets a few probe requests through to check if it recovered.
+type CircuitBreaker struct {
+	mu sync.Mutex
+
+	config *config.CircuitBreaker
+
+	state BreakerState
+
+	// Consecutive failed requests.
+	consecutiveFailures int
+
+	// Requests and failures since the start of the current window.
+	requests int
+	failures int
+
+	windowStart time.Time
+
+	// Time when the circuit was opened.
+	openedAt time.Time
+
+	// Probe requests sent and successful while the circuit is half-open.
+	probes    int
+	successes int
+}
+
+// Ready reports if the breaker would let a request through,
+// unlike Allow it does not reserve a probe request.
+func (b *CircuitBreaker) Ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case Open:
+		return time.Since(b.openedAt) >= b.config.OpenTime
+	case HalfOpen:
+		return b.probes < b.config.HalfOpenRequests
+	}
+	return true
+}
+
+// Allow reports if a request can be sent to the server, every allowed
+// request must be followed by a call to Record with its result.
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == Open {
+		if time.Since(b.openedAt) < b.config.OpenTime {
+			return false
+		}
+		b.state = HalfOpen
+		b.probes = 0
+		b.successes = 0
+	}
+
+	if b.state == HalfOpen {
+		if b.probes >= b.config.HalfOpenRequests {
+			return false
+		}
+		b.probes++
+	}
+	return true
+}
+
+// Release gives back the probe reserved by Allow for a request that has
+// no result, such as one whose client failed.
+func (b *CircuitBreaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == HalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// Record registers the result of a request and returns
+// the new state if the state of the breaker changed.
+func (b *CircuitBreaker) Record(failed bool) (BreakerState, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case HalfOpen:
+		if failed {
+			b.open()
+			return b.state, true
+		}
+		b.successes++
+		if b.successes >= b.config.HalfOpenRequests {
+			b.close()
+			return b.state, true
+		}
+	case Closed:
+		now := time.Now()
+		if now.Sub(b.windowStart) > b.config.Window {
+			b.windowStart = now
+			b.requests = 0
+			b.failures = 0
+		}
+
+		b.requests++
+		if !failed {
+			b.consecutiveFailures = 0
+			return b.state, false
+		}
+		b.failures++
+		b.consecutiveFailures++
+
+		if b.config.ConsecutiveFailures > 0 &&
+			b.consecutiveFailures >= b.config.ConsecutiveFailures {
+			b.open()
+			return b.state, true
+		}
+		if b.requests >= b.config.MinRequests &&
+			b.failures*100 >= b.config.ErrorRate*b.requests {
+			b.open()
+			return b.state, true
+		}
+	}
+	return b.state, false
+}
+
+// Failed reports if the status code of a response is considered a failure.
+func (b *CircuitBreaker) Failed(statusCode int) bool {
+	for _, status := range b.config.Status {
+		if status == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryAfter returns the time remaining until the circuit allows
+// probe requests, zero if it is not open.
+func (b *CircuitBreaker) RetryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != Open {
+		return 0
+	}
+	remaining := b.config.OpenTime - time.Since(b.openedAt)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+func (b *CircuitBreaker) open() {
+	b.state = Open
+	b.openedAt = time.Now()
+}
+
+func (b *CircuitBreaker) close() {
+	b.state = Closed
+	b.consecutiveFailures = 0
+	b.requests = 0
+	b.failures = 0
+	b.windowStart = time.Now()
+}
+
+func NewCircuitBreaker(config *config.CircuitBreaker) *CircuitBreaker {
+	return &CircuitBreaker{
+		config:      config,
+		state:       Closed,
+		windowStart: time.Now(),
+	}
+}
@@ -1,15 +1,44 @@
 package lb
 
-import "github.com/MAD-py/grx/pkg/config"
+import (
+	"time"
+
+	"github.com/MAD-py/grx/pkg/config"
+)
 
 type LoadBalancer interface {
-	GetServer() string
+	// GetServer returns the server that will process the next request,
+	// nil if none of the servers is available.
+	GetServer() *Backend
+
+	// Servers returns all the servers in the balancer.
+	Servers() []*Backend
+
+	// Update replaces the servers of the balancer and returns
+	// the servers added and removed.
+	Update(servers []*config.Forward) (added, removed []*Backend)
 }
 
+// Observer is implemented by the balancers that take into account
+// the latency of the responses to choose a server.
+type Observer interface {
+	Observe(backend *Backend, latency time.Duration)
+}
+
+// Base always uses the first available server.
 type Base struct {
-	server *config.Forward
+	pool
 }
 
-func (a *Base) GetServer() string { return a.server.Addr }
+func (a *Base) GetServer() *Backend {
+	for _, server := range a.Servers() {
+		if server.Available() {
+			return server
+		}
+	}
+	return nil
+}
 
-func NewBase(server *config.Forward) *Base { return &Base{server: server} }
+func NewBase(server *config.Forward) *Base {
+	return &Base{pool: newPool([]*config.Forward{server})}
+}
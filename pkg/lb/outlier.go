@@ -0,0 +1,131 @@
+package lb
+
+import (
+	"sync"
+	"time"
+
+	"github.com/MAD-py/grx/pkg/config"
+)
+
+// OutlierDetector ejects temporarily the servers that fail too many
+// requests, each consecutive ejection of a server lasts longer.
+type OutlierDetector struct {
+	mu sync.Mutex
+
+	config *config.OutlierDetection
+
+	// Balancer whose servers are monitored.
+	loadBalancer LoadBalancer
+
+	// Failure history of each server.
+	stats map[*Backend]*outlierStats
+}
+
+type outlierStats struct {
+	// Failures since the start of the current window.
+	failures int
+
+	// Start of the current window of failures.
+	windowStart time.Time
+
+	// Consecutive ejections of the server.
+	ejections int
+
+	// End of the last ejection.
+	ejectionEnd time.Time
+}
+
+// Failed reports if the status code of a response is considered a failure.
+func (d *OutlierDetector) Failed(statusCode int) bool {
+	for _, status := range d.config.Status {
+		if status == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// Success records a successful request of the server.
+func (d *OutlierDetector) Success(backend *Backend) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats, ok := d.stats[backend]
+	if !ok {
+		return
+	}
+
+	// The ejections are forgotten once the server has worked
+	// properly during the maximum ejection time.
+	if stats.ejections > 0 &&
+		time.Since(stats.ejectionEnd) > d.config.MaxEjectionTime {
+		stats.ejections = 0
+	}
+}
+
+// Failure records a failed request of the server, if the server exceeds
+// the allowed failures it is ejected and the ejection time is returned.
+func (d *OutlierDetector) Failure(backend *Backend) (time.Duration, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats, ok := d.stats[backend]
+	if !ok {
+		stats = &outlierStats{}
+		d.stats[backend] = stats
+	}
+
+	if backend.Ejected() {
+		return 0, false
+	}
+
+	now := time.Now()
+	if now.Sub(stats.windowStart) > d.config.FailTimeout {
+		stats.failures = 0
+		stats.windowStart = now
+	}
+	stats.failures++
+	if stats.failures < d.config.MaxFails || !d.canEject() {
+		return 0, false
+	}
+
+	stats.failures = 0
+	stats.ejections++
+	duration := d.config.EjectionTime * time.Duration(stats.ejections)
+	if duration > d.config.MaxEjectionTime {
+		duration = d.config.MaxEjectionTime
+	}
+	stats.ejectionEnd = now.Add(duration)
+	backend.ejectedUntil.Store(stats.ejectionEnd.UnixNano())
+	return duration, true
+}
+
+// Remove forgets the history of a server removed from the balancer.
+func (d *OutlierDetector) Remove(backend *Backend) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.stats, backend)
+}
+
+// canEject reports if one more server can be ejected without
+// exceeding the maximum percentage of ejected servers.
+func (d *OutlierDetector) canEject() bool {
+	servers := d.loadBalancer.Servers()
+	ejected := 1
+	for _, server := range servers {
+		if server.Ejected() {
+			ejected++
+		}
+	}
+	return ejected*100 <= d.config.MaxEjectionPercent*len(servers)
+}
+
+func NewOutlierDetector(
+	loadBalancer LoadBalancer, config *config.OutlierDetection,
+) *OutlierDetector {
+	return &OutlierDetector{
+		config:       config,
+		loadBalancer: loadBalancer,
+		stats:        make(map[*Backend]*outlierStats),
+	}
+}
@@ -0,0 +1,49 @@
+package lb
+
+import (
+	"math/rand"
+
+	"github.com/MAD-py/grx/pkg/config"
+)
+
+// PowerOfTwoChoices picks two servers at random and chooses the one with
+// fewer requests in progress, relative to their ramp during slow start.
+type PowerOfTwoChoices struct {
+	pool
+}
+
+func (lb *PowerOfTwoChoices) GetServer() *Backend {
+	servers := available(lb.Servers())
+	if len(servers) == 0 {
+		return nil
+	}
+
+	a, b := pickTwo(servers)
+	if load(b) < load(a) {
+		return b
+	}
+	return a
+}
+
+func NewPowerOfTwoChoices(servers []*config.Forward) *PowerOfTwoChoices {
+	return &PowerOfTwoChoices{pool: newPool(servers)}
+}
+
+func load(backend *Backend) float64 {
+	return float64(backend.Inflight()+1) / backend.Ramp()
+}
+
+// pickTwo returns two different servers chosen at random, if there
+// is only one server it is returned twice.
+func pickTwo(servers []*Backend) (*Backend, *Backend) {
+	if len(servers) == 1 {
+		return servers[0], servers[0]
+	}
+
+	i := rand.Intn(len(servers))
+	j := rand.Intn(len(servers) - 1)
+	if j >= i {
+		j++
+	}
+	return servers[i], servers[j]
+}
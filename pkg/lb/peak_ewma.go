@@ -0,0 +1,109 @@
+package lb
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/MAD-py/grx/pkg/config"
+)
+
+const (
+	// Time in which the weight of a latency sample decays to 1/e.
+	ewmaDecay = 10 * time.Second
+
+	// Latency assumed for a server that has requests in progress but no
+	// latency samples yet, it prevents sending all the traffic to a new
+	// server.
+	ewmaPenalty = float64(time.Second)
+)
+
+// PeakEWMA chooses between two random servers the one with the lowest
+// cost, the cost is the exponentially weighted moving average of the
+// latency multiplied by the requests in progress. Latency peaks are
+// taken immediately so that a slow server is penalized quickly.
+type PeakEWMA struct {
+	pool
+
+	mu sync.Mutex
+
+	// Latency statistics of each server.
+	stats map[*Backend]*ewma
+}
+
+type ewma struct {
+	// Average latency in nanoseconds.
+	value float64
+
+	// Time of the last sample.
+	timestamp time.Time
+}
+
+func (lb *PeakEWMA) GetServer() *Backend {
+	servers := available(lb.Servers())
+	if len(servers) == 0 {
+		return nil
+	}
+
+	a, b := pickTwo(servers)
+	if lb.cost(b) < lb.cost(a) {
+		return b
+	}
+	return a
+}
+
+func (lb *PeakEWMA) Update(servers []*config.Forward) (added, removed []*Backend) {
+	added, removed = lb.pool.Update(servers)
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	for _, server := range removed {
+		delete(lb.stats, server)
+	}
+	return added, removed
+}
+
+// Observe adds a latency sample to the average of the server.
+func (lb *PeakEWMA) Observe(backend *Backend, latency time.Duration) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	stat, ok := lb.stats[backend]
+	if !ok {
+		stat = &ewma{}
+		lb.stats[backend] = stat
+	}
+
+	now := time.Now()
+	sample := float64(latency)
+	if sample > stat.value || stat.timestamp.IsZero() {
+		stat.value = sample
+	} else {
+		elapsed := now.Sub(stat.timestamp)
+		w := math.Exp(-float64(elapsed) / float64(ewmaDecay))
+		stat.value = stat.value*w + sample*(1-w)
+	}
+	stat.timestamp = now
+}
+
+func (lb *PeakEWMA) cost(backend *Backend) float64 {
+	var latency float64
+	lb.mu.Lock()
+	if stat, ok := lb.stats[backend]; ok {
+		latency = stat.value
+	}
+	lb.mu.Unlock()
+
+	inflight := float64(backend.Inflight())
+	if latency == 0 && inflight > 0 {
+		return ewmaPenalty * (inflight + 1) / backend.Ramp()
+	}
+	return latency * (inflight + 1) / backend.Ramp()
+}
+
+func NewPeakEWMA(servers []*config.Forward) *PeakEWMA {
+	return &PeakEWMA{
+		pool:  newPool(servers),
+		stats: make(map[*Backend]*ewma, len(servers)),
+	}
+}
@@ -0,0 +1,44 @@
+package lb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MAD-py/grx/pkg/config"
+)
+
+func TestPeakEWMACostColdBackend(t *testing.T) {
+	lb := NewPeakEWMA([]*config.Forward{
+		{Addr: "127.0.0.1:8001", Weight: 1},
+		{Addr: "127.0.0.1:8002", Weight: 1},
+	})
+	servers := lb.Servers()
+	cold, idle := servers[0], servers[1]
+
+	// The idle server is slower than the penalty but has no requests in
+	// progress, the cold one has two.
+	lb.Observe(idle, 2*time.Second)
+	cold.Start()
+	cold.Start()
+
+	if got, want := lb.cost(cold), 3*ewmaPenalty; got != want {
+		t.Fatalf("cost of the cold server = %v, want %v", got, want)
+	}
+	if lb.cost(cold) <= lb.cost(idle) {
+		t.Fatalf(
+			"cold server with requests in progress (%v) is cheaper than the idle one (%v)",
+			lb.cost(cold), lb.cost(idle),
+		)
+	}
+	for i := 0; i < 10; i++ {
+		if got := lb.GetServer(); got != idle {
+			t.Fatalf("GetServer() = %s, want %s", got.Addr, idle.Addr)
+		}
+	}
+
+	cold.Done()
+	cold.Done()
+	if got := lb.cost(cold); got != 0 {
+		t.Fatalf("cost of the cold server without requests = %v, want 0", got)
+	}
+}
@@ -0,0 +1,59 @@
+package lb
+
+import (
+	"sync"
+
+	"github.com/MAD-py/grx/pkg/config"
+)
+
+// pool is the list of servers of a balancer, it can be replaced at any
+// time without interrupting the requests in progress.
+type pool struct {
+	mu sync.RWMutex
+
+	servers []*Backend
+}
+
+// Servers returns all the servers in the balancer.
+func (p *pool) Servers() []*Backend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.servers
+}
+
+// Update replaces the servers of the balancer, the servers that do not
+// change keep their state (health, circuit breaker...). The requests in
+// progress on the removed servers are not affected.
+func (p *pool) Update(forwards []*config.Forward) (added, removed []*Backend) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current := make(map[string]*Backend, len(p.servers))
+	for _, server := range p.servers {
+		current[server.Addr] = server
+	}
+
+	servers := make([]*Backend, 0, len(forwards))
+	for _, forward := range forwards {
+		server, ok := current[forward.Addr]
+		if ok && server.matches(forward) {
+			delete(current, forward.Addr)
+		} else {
+			server = NewBackend(forward)
+			added = append(added, server)
+		}
+		servers = append(servers, server)
+	}
+
+	for _, server := range p.servers {
+		if current[server.Addr] == server {
+			removed = append(removed, server)
+		}
+	}
+	p.servers = servers
+	return added, removed
+}
+
+func newPool(forwards []*config.Forward) pool {
+	return pool{servers: newBackends(forwards)}
+}
@@ -1,28 +1,43 @@
 package lb
 
-import "github.com/MAD-py/grx/pkg/config"
+import (
+	"math/rand"
+	"sync"
+
+	"github.com/MAD-py/grx/pkg/config"
+)
 
 type RoundRobin struct {
-	servers []*config.Forward
+	pool
 
-	index uint8
+	mu sync.Mutex
 
-	maxIndex uint8
+	// Number of times a server has been selected.
+	counter uint64
 }
 
-func (lb *RoundRobin) GetServer() string {
-	server := lb.servers[lb.index]
-	lb.index++
-	if lb.index > lb.maxIndex {
-		lb.index = 0
+func (lb *RoundRobin) GetServer() *Backend {
+	servers := available(lb.Servers())
+	if len(servers) == 0 {
+		return nil
 	}
-	return server.Addr
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	// The servers in slow start are skipped randomly according to
+	// their ramp, but one of them is used if all are skipped.
+	var server *Backend
+	for range servers {
+		server = servers[lb.counter%uint64(len(servers))]
+		lb.counter++
+		if ramp := server.Ramp(); ramp == 1 || rand.Float64() < ramp {
+			break
+		}
+	}
+	return server
 }
 
 func NewRoundRobin(servers []*config.Forward) *RoundRobin {
-	return &RoundRobin{
-		servers:  servers,
-		index:    0,
-		maxIndex: uint8(len(servers) - 1),
-	}
+	return &RoundRobin{pool: newPool(servers)}
 }
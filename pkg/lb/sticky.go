@@ -0,0 +1,71 @@
+package lb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+)
+
+// Sticky wraps a load balancer to keep the clients attached to a server,
+// each server is identified by an opaque key so that the addresses of the
+// servers are never exposed to the clients.
+type Sticky struct {
+	LoadBalancer
+
+	// Key of the HMAC of the addresses, without it the addresses could be
+	// guessed from the keys.
+	secret []byte
+
+	mu sync.RWMutex
+
+	// Cache of the keys already calculated, indexed by address.
+	keys map[string]string
+}
+
+// GetStickyServer returns the server identified by the key, if that server
+// is no longer part of the balancer or it is not available it returns false.
+func (s *Sticky) GetStickyServer(key string) (*Backend, bool) {
+	for _, server := range s.Servers() {
+		if s.Key(server.Addr) == key {
+			return server, server.Available()
+		}
+	}
+	return nil, false
+}
+
+// Key returns the opaque key that identifies the server.
+func (s *Sticky) Key(addr string) string {
+	s.mu.RLock()
+	key, ok := s.keys[addr]
+	s.mu.RUnlock()
+	if ok {
+		return key
+	}
+
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(addr))
+	key = hex.EncodeToString(mac.Sum(nil)[:16])
+
+	s.mu.Lock()
+	s.keys[addr] = key
+	s.mu.Unlock()
+	return key
+}
+
+// Forget removes the cached keys of the servers removed from the balancer.
+func (s *Sticky) Forget(servers []*Backend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, server := range servers {
+		delete(s.keys, server.Addr)
+	}
+}
+
+func NewSticky(loadBalancer LoadBalancer, secret []byte) *Sticky {
+	return &Sticky{
+		LoadBalancer: loadBalancer,
+		secret:       secret,
+		keys:         make(map[string]string),
+	}
+}
@@ -1,43 +1,75 @@
 package lb
 
 import (
-	"sort"
+	"sync"
 
 	"github.com/MAD-py/grx/pkg/config"
 )
 
+// Scale applied to the weights so that the ramp of the servers in
+// slow start can be expressed with integers.
+const weightScale = 100
+
+// WeightedRoundRobin uses the smooth weighted round robin, each server
+// receives as many requests as its weight but interleaved with the other
+// servers, and the servers that are not available are simply skipped.
 type WeightedRoundRobin struct {
-	servers []*config.Forward
+	pool
+
+	mu sync.Mutex
+
+	// Current weight of each server.
+	currentWeights map[*Backend]int
+}
 
-	index uint8
+func (lb *WeightedRoundRobin) GetServer() *Backend {
+	servers := lb.Servers()
+	backup := useBackup(servers)
 
-	maxIndex uint8
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
 
-	currentWeight uint8
+	var best *Backend
+	total := 0
+	for _, server := range servers {
+		if server.Backup != backup || !server.Available() {
+			continue
+		}
+
+		weight := int(float64(int(server.Weight)*weightScale) * server.Ramp())
+		if weight == 0 {
+			weight = 1
+		}
+		lb.currentWeights[server] += weight
+		total += weight
+		if best == nil || lb.currentWeights[server] > lb.currentWeights[best] {
+			best = server
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+	lb.currentWeights[best] -= total
+	return best
 }
 
-func (lb *WeightedRoundRobin) GetServer() string {
-	server := lb.servers[lb.index]
-	lb.currentWeight--
+func (lb *WeightedRoundRobin) Update(
+	servers []*config.Forward,
+) (added, removed []*Backend) {
+	added, removed = lb.pool.Update(servers)
 
-	if lb.index == lb.maxIndex && lb.currentWeight == 0 {
-		lb.index = 0
-		lb.currentWeight = lb.servers[0].Weight
-	} else if lb.currentWeight == 0 {
-		lb.index++
-		lb.currentWeight = lb.servers[lb.index].Weight
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	for _, server := range removed {
+		delete(lb.currentWeights, server)
 	}
-	return server.Addr
+	return added, removed
 }
 
 func NewWeightedRoundRobin(servers []*config.Forward) *WeightedRoundRobin {
-	sort.Slice(servers, func(i, j int) bool {
-		return servers[i].Weight > servers[j].Weight
-	})
 	return &WeightedRoundRobin{
-		servers:       servers,
-		index:         0,
-		maxIndex:      uint8(len(servers) - 1),
-		currentWeight: servers[0].Weight,
+		pool:           newPool(servers),
+		currentWeights: make(map[*Backend]int, len(servers)),
 	}
 }